@@ -0,0 +1,332 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// BodyEncodingText stores captured bodies as text, falling back to base64 for content
+	// that is not valid UTF-8.
+	BodyEncodingText = "text"
+	// BodyEncodingBase64 always stores captured bodies base64 encoded.
+	BodyEncodingBase64 = "base64"
+
+	defaultBodyEncoding = BodyEncodingText
+
+	defaultResponseBodyStatuses = "400-599"
+
+	// compressionOverhead bounds the size of the gzip and zlib headers and trailers, unless gzip
+	// headers carry optional fields such as a file name.
+	compressionOverhead = 64
+)
+
+// defaultBodyContentTypes are the media types whose bodies are captured when none are configured.
+var defaultBodyContentTypes = []string{
+	"application/json",
+	"application/graphql",
+	"application/x-www-form-urlencoded",
+	"text/*",
+}
+
+// Body is a captured HTTP message body.
+type Body struct {
+	// Content is the captured part of the body.
+	Content string `json:"content"`
+	// Encoding is set to base64 when Content is base64 encoded.
+	Encoding string `json:"encoding,omitempty"`
+	// Truncated reports whether the body was longer than the captured content.
+	Truncated bool `json:"truncated"`
+}
+
+// bodyCapture decides which bodies are captured and how they are stored.
+type bodyCapture struct {
+	maxBytes     int
+	contentTypes []string
+	base64       bool
+}
+
+// newBodyCapture creates a body capture limited to maxBytes, or returns nil when maxBytes is zero.
+func newBodyCapture(maxBytes int, contentTypes []string, encoding string) (*bodyCapture, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid maximum body size: %d", maxBytes)
+	}
+	if maxBytes == 0 {
+		return nil, nil
+	}
+
+	c := &bodyCapture{maxBytes: maxBytes}
+
+	switch encoding {
+	case "", BodyEncodingText:
+	case BodyEncodingBase64:
+		c.base64 = true
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q: expected %s or %s", encoding, BodyEncodingText, BodyEncodingBase64)
+	}
+
+	if len(contentTypes) == 0 {
+		contentTypes = defaultBodyContentTypes
+	}
+	for _, contentType := range contentTypes {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if !strings.Contains(contentType, "/") {
+			return nil, fmt.Errorf("invalid body content type %q", contentType)
+		}
+		c.contentTypes = append(c.contentTypes, contentType)
+	}
+
+	return c, nil
+}
+
+// accepts reports whether request bodies with the given Content-Type header are captured.
+func (c *bodyCapture) accepts(contentType string) bool {
+	if c == nil || contentType == "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range c.contentTypes {
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// body builds the Body of a captured content; total is the size of the whole body, or -1
+// when it is unknown.
+func (c *bodyCapture) body(content []byte, total int64, truncated bool) *Body {
+	b := &Body{Truncated: truncated || (total >= 0 && int64(len(content)) < total)}
+
+	if c.base64 || !utf8.Valid(content) {
+		b.Content = base64.StdEncoding.EncodeToString(content)
+		b.Encoding = BodyEncodingBase64
+		return b
+	}
+
+	b.Content = string(content)
+	return b
+}
+
+// teeBody wraps a request body and keeps a copy of the first bytes read through it, so that
+// the upstream receives the body unmodified and streaming uploads are never buffered whole.
+type teeBody struct {
+	io.ReadCloser
+
+	mu        sync.Mutex
+	max       int
+	captured  []byte
+	truncated bool
+}
+
+// captureRequestBody replaces the body of req with a teeBody when its content type is captured.
+func (c *bodyCapture) captureRequestBody(req *http.Request) *teeBody {
+	if req.Body == nil || req.Body == http.NoBody || !c.accepts(req.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	tee := &teeBody{ReadCloser: req.Body, max: c.maxBytes}
+	req.Body = tee
+
+	return tee
+}
+
+// Read implements io.Reader.
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	t.mu.Lock()
+	t.captured, t.truncated = appendCapped(t.captured, p[:n], t.max, t.truncated)
+	t.mu.Unlock()
+
+	return n, err
+}
+
+// content returns a copy of the captured bytes and whether bytes were left out.
+func (t *teeBody) content() ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]byte(nil), t.captured...), t.truncated
+}
+
+// appendCapped appends p to buf without letting buf grow past max bytes. It reports
+// whether bytes were left out, including by earlier calls.
+func appendCapped(buf, p []byte, max int, truncated bool) ([]byte, bool) {
+	if room := max - len(buf); len(p) > room {
+		return append(buf, p[:room]...), true
+	}
+	return append(buf, p...), truncated
+}
+
+// statusRange is an inclusive range of HTTP status codes.
+type statusRange struct {
+	min, max int
+}
+
+// parseStatusRanges parses a comma-separated list of status codes and ranges, such as "400-599"
+// or "404,500-504".
+func parseStatusRanges(value string) ([]statusRange, error) {
+	var ranges []statusRange
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r statusRange
+		bounds := strings.SplitN(part, "-", 2)
+		if _, err := fmt.Sscanf(bounds[0], "%d", &r.min); err != nil {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+		r.max = r.min
+		if len(bounds) == 2 {
+			if _, err := fmt.Sscanf(bounds[1], "%d", &r.max); err != nil {
+				return nil, fmt.Errorf("invalid status range %q", part)
+			}
+		}
+		if r.min < 100 || r.max > 999 || r.min > r.max {
+			return nil, fmt.Errorf("invalid status range %q", part)
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errors.New("empty status range")
+	}
+	return ranges, nil
+}
+
+func statusInRanges(status int, ranges []statusRange) bool {
+	for _, r := range ranges {
+		if status >= r.min && status <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBodyCapture keeps the beginning of response bodies whose status is in statuses.
+type responseBodyCapture struct {
+	*bodyCapture
+	statuses []statusRange
+}
+
+// newResponseBodyCapture creates a response body capture, or returns nil when maxBytes is zero.
+func newResponseBodyCapture(maxBytes int, statuses, encoding string) (*responseBodyCapture, error) {
+	capture, err := newBodyCapture(maxBytes, nil, encoding)
+	if err != nil || capture == nil {
+		return nil, err
+	}
+
+	if statuses == "" {
+		statuses = defaultResponseBodyStatuses
+	}
+	ranges, err := parseStatusRanges(statuses)
+	if err != nil {
+		return nil, err
+	}
+
+	return &responseBodyCapture{bodyCapture: capture, statuses: ranges}, nil
+}
+
+// captures reports whether the body of a response with the given status is captured.
+func (c *responseBodyCapture) captures(status int) bool {
+	return c != nil && statusInRanges(status, c.statuses)
+}
+
+// body decodes the content captured by rec according to its Content-Encoding.
+func (c *responseBodyCapture) body(rec *responseRecorder) *Body {
+	if !rec.bodyCaptured {
+		return nil
+	}
+
+	encoding := rec.Header().Get("Content-Encoding")
+	if !isCompressed(encoding) {
+		return c.bodyCapture.body(rec.body, -1, rec.bodyTruncated)
+	}
+
+	content, truncated, err := decompress(encoding, rec.body, c.maxBytes)
+	if err != nil {
+		return c.bodyCapture.body(rec.body, -1, rec.bodyTruncated)
+	}
+	return c.bodyCapture.body(content, -1, truncated)
+}
+
+// rawLimit is the number of bytes kept from a response body with the given Content-Encoding.
+// Compressed bodies are given room for the compression framing and for the expansion of
+// incompressible data, which deflate encoders store in blocks with a few bytes of overhead each.
+// A body that fits in maxBytes once decompressed can still be cut short when its gzip header
+// carries optional fields, such as a file name, longer than compressionOverhead.
+func (c *responseBodyCapture) rawLimit(encoding string) int {
+	if isCompressed(encoding) {
+		return c.maxBytes + c.maxBytes>>12 + c.maxBytes>>14 + compressionOverhead
+	}
+	return c.maxBytes
+}
+
+func isCompressed(encoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip", "deflate":
+		return true
+	default:
+		return false
+	}
+}
+
+// decompress decompresses the gzip or deflate encoded raw content, keeping at most max bytes.
+// raw may have been cut short, in which case what could be decompressed is returned and
+// reported as truncated.
+func decompress(encoding string, raw []byte, max int) ([]byte, bool, error) {
+	var (
+		r   io.Reader
+		err error
+	)
+	if strings.EqualFold(strings.TrimSpace(encoding), "deflate") {
+		// The deflate content coding is zlib-wrapped, but some servers send raw deflate data.
+		if r, err = zlib.NewReader(bytes.NewReader(raw)); err != nil {
+			r, err = flate.NewReader(bytes.NewReader(raw)), nil
+		}
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(raw))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	content, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	truncated := len(content) > max
+	if err != nil {
+		if !errors.Is(err, io.ErrUnexpectedEOF) || len(content) == 0 {
+			return nil, false, err
+		}
+		truncated = true
+	}
+	if len(content) > max {
+		content = content[:max]
+	}
+	return content, truncated, nil
+}
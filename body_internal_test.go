@@ -0,0 +1,48 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestResponseBodyRawLimitFitsIncompressibleBodies(t *testing.T) {
+	testCases := []struct {
+		encoding string
+		writer   func(w io.Writer) io.WriteCloser
+	}{
+		{encoding: "gzip", writer: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{encoding: "deflate", writer: func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.encoding, func(t *testing.T) {
+			for _, maxBytes := range []int{1, 1024, 1 << 20} {
+				data := make([]byte, maxBytes)
+				if _, err := rand.Read(data); err != nil {
+					t.Fatal(err)
+				}
+
+				var buf bytes.Buffer
+				w := test.writer(&buf)
+				if _, err := w.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				c := &responseBodyCapture{bodyCapture: &bodyCapture{maxBytes: maxBytes}}
+				if limit := c.rawLimit(test.encoding); buf.Len() > limit {
+					t.Errorf("%d random bytes compressed to %d bytes, above the limit of %d", maxBytes, buf.Len(), limit)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestRequestBodyCapture(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		maxBytes    int
+		encoding    string
+		contentType string
+		body        string
+		expected    interface{}
+	}{
+		{
+			desc:        "disabled",
+			contentType: "application/json",
+			body:        `{"query":"{ me { id } }"}`,
+		},
+		{
+			desc:        "whole body",
+			maxBytes:    1024,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"query":"{ me { id } }"}`,
+			expected:    map[string]interface{}{"content": `{"query":"{ me { id } }"}`, "truncated": false},
+		},
+		{
+			desc:        "truncated body",
+			maxBytes:    8,
+			contentType: "text/plain",
+			body:        "hello, world",
+			expected:    map[string]interface{}{"content": "hello, w", "truncated": true},
+		},
+		{
+			desc:        "content type not allowed",
+			maxBytes:    1024,
+			contentType: "application/octet-stream",
+			body:        "binary",
+		},
+		{
+			desc:        "invalid UTF-8 falls back to base64",
+			maxBytes:    1024,
+			contentType: "text/plain",
+			body:        "\xff\xfe",
+			expected:    map[string]interface{}{"content": "//4=", "encoding": "base64", "truncated": false},
+		},
+		{
+			desc:        "base64 encoding",
+			maxBytes:    1024,
+			encoding:    traefik_plugin_elastic.BodyEncodingBase64,
+			contentType: "text/plain",
+			body:        "hello",
+			expected:    map[string]interface{}{"content": "aGVsbG8=", "encoding": "base64", "truncated": false},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.RequestBodyMaxBytes = test.maxBytes
+			cfg.BodyEncoding = test.encoding
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					t.Errorf("Could not read the request body: %v", err)
+				}
+				if string(body) != test.body {
+					t.Errorf("upstream received %q, expected %q", body, test.body)
+				}
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://test.com/graphql", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			if got := docs[0]["request_body"]; !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected request body %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestResponseBodyCapture(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		statuses string
+		status   int
+		encoding string
+		body     string
+		expected interface{}
+	}{
+		{
+			desc:   "successful response",
+			status: http.StatusOK,
+			body:   `{"data":{}}`,
+		},
+		{
+			desc:     "error response",
+			status:   http.StatusInternalServerError,
+			body:     `{"error":"boom"}`,
+			expected: map[string]interface{}{"content": `{"error":"boom"}`, "truncated": false},
+		},
+		{
+			desc:     "truncated error response",
+			status:   http.StatusBadGateway,
+			body:     strings.Repeat("x", 64),
+			expected: map[string]interface{}{"content": strings.Repeat("x", 32), "truncated": true},
+		},
+		{
+			desc:     "gzip error response",
+			status:   http.StatusNotFound,
+			encoding: "gzip",
+			body:     "not found",
+			expected: map[string]interface{}{"content": "not found", "truncated": false},
+		},
+		{
+			desc:     "truncated gzip error response",
+			status:   http.StatusNotFound,
+			encoding: "gzip",
+			body:     strings.Repeat("x", 64),
+			expected: map[string]interface{}{"content": strings.Repeat("x", 32), "truncated": true},
+		},
+		{
+			desc:     "deflate error response",
+			status:   http.StatusNotFound,
+			encoding: "deflate",
+			body:     "not found",
+			expected: map[string]interface{}{"content": "not found", "truncated": false},
+		},
+		{
+			desc:     "status outside the configured ranges",
+			statuses: "500-599",
+			status:   http.StatusNotFound,
+			body:     "not found",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.ResponseBodyMaxBytes = 32
+			cfg.ResponseBodyStatuses = test.statuses
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body := []byte(test.body)
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+					body = compress(t, test.encoding, body)
+				}
+				w.WriteHeader(test.status)
+				_, _ = w.Write(body)
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			if got := docs[0]["response_body"]; !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected response body %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %s", encoding)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	return buf.Bytes()
+}
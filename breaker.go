@@ -0,0 +1,233 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+const (
+	defaultCircuitBreakerMinRequests      = 10
+	defaultCircuitBreakerWindow           = "10s"
+	defaultCircuitBreakerOpenDuration     = "30s"
+	defaultCircuitBreakerHalfOpenRequests = 1
+)
+
+// Circuit breaker states, as reported by Metrics.CircuitBreakerState.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// errCircuitOpen is returned instead of sending a request while the circuit breaker is open.
+var errCircuitOpen = errors.New("the circuit breaker is open")
+
+// circuitState is the state of a circuit breaker, stored in metrics.circuitState.
+type circuitState int32
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return CircuitOpen
+	case circuitHalfOpen:
+		return CircuitHalfOpen
+	default:
+		return CircuitClosed
+	}
+}
+
+// circuitBreaker wraps the transport of the Elasticsearch client. It opens when too many requests
+// fail within a window, rejecting requests with errCircuitOpen instead of sending them, so that
+// workers stop piling up on an unresponsive cluster. Once openDuration has elapsed, it lets a few
+// probe requests through: it closes again if they all succeed, and opens again if one fails.
+type circuitBreaker struct {
+	transport esapi.Transport
+	metrics   *metrics
+
+	failureRate      float64
+	minRequests      int
+	window           time.Duration
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	mu    sync.Mutex
+	state circuitState
+	// windowStart is when the requests and failures of the current window started being counted.
+	windowStart time.Time
+	requests    int
+	failures    int
+	// openedAt is when the circuit breaker last opened.
+	openedAt time.Time
+	// probes is the number of probe requests sent since the circuit breaker went half-open, and
+	// succeeded the number of them that succeeded.
+	probes    int
+	succeeded int
+}
+
+// newCircuitBreaker returns a circuit breaker around transport as configured by config, or nil when
+// the circuit breaker is disabled.
+func newCircuitBreaker(config *Config, transport esapi.Transport, m *metrics) (*circuitBreaker, error) {
+	if config.CircuitBreakerFailureRate < 0 || config.CircuitBreakerFailureRate > 1 {
+		return nil, fmt.Errorf("invalid circuit breaker failure rate %v: expected a value between 0 and 1", config.CircuitBreakerFailureRate)
+	}
+	if config.CircuitBreakerFailureRate == 0 {
+		return nil, nil
+	}
+
+	b := &circuitBreaker{
+		transport:        transport,
+		metrics:          m,
+		failureRate:      config.CircuitBreakerFailureRate,
+		minRequests:      config.CircuitBreakerMinRequests,
+		halfOpenRequests: config.CircuitBreakerHalfOpenRequests,
+	}
+	if b.minRequests < 0 {
+		return nil, fmt.Errorf("invalid circuit breaker minimum number of requests: %d", b.minRequests)
+	}
+	if b.minRequests == 0 {
+		b.minRequests = defaultCircuitBreakerMinRequests
+	}
+	if b.halfOpenRequests < 0 {
+		return nil, fmt.Errorf("invalid circuit breaker number of half-open requests: %d", b.halfOpenRequests)
+	}
+	if b.halfOpenRequests == 0 {
+		b.halfOpenRequests = defaultCircuitBreakerHalfOpenRequests
+	}
+
+	var err error
+	if b.window, err = parseDuration(config.CircuitBreakerWindow, defaultCircuitBreakerWindow); err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker window: %w", err)
+	}
+	if b.openDuration, err = parseDuration(config.CircuitBreakerOpenDuration, defaultCircuitBreakerOpenDuration); err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker open duration: %w", err)
+	}
+
+	return b, nil
+}
+
+// Perform sends req through the wrapped transport, unless the circuit breaker is open.
+func (b *circuitBreaker) Perform(req *http.Request) (*http.Response, error) {
+	if !b.allow() {
+		atomic.AddInt64(&b.metrics.shortCircuited, 1)
+		return nil, errCircuitOpen
+	}
+
+	res, err := b.transport.Perform(req)
+	b.record(err == nil && res.StatusCode != http.StatusTooManyRequests && res.StatusCode < http.StatusInternalServerError)
+	return res, err
+}
+
+// allow reports whether a request can be sent, turning the circuit breaker half-open once it has
+// been open for openDuration.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.openDuration {
+		b.transition(circuitHalfOpen, fmt.Sprintf("probing Elasticsearch after %s", b.openDuration))
+	}
+
+	switch b.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		if b.probes >= b.halfOpenRequests {
+			return false
+		}
+		b.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+// record counts the outcome of a request sent through the circuit breaker.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		if !success {
+			b.transition(circuitOpen, "a probe request to Elasticsearch failed")
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.halfOpenRequests {
+			b.transition(circuitClosed, fmt.Sprintf("%d probe requests to Elasticsearch succeeded", b.succeeded))
+		}
+		return
+	}
+	if b.state != circuitClosed {
+		// A request sent before the circuit breaker opened.
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if success {
+		return
+	}
+	b.failures++
+	if b.requests >= b.minRequests && float64(b.failures) >= b.failureRate*float64(b.requests) {
+		b.transition(circuitOpen, fmt.Sprintf("%d of %d requests to Elasticsearch failed within %s", b.failures, b.requests, b.window))
+	}
+}
+
+// rejecting reports whether requests are currently rejected without being sent: the circuit
+// breaker is open and not yet due for a probe.
+func (b *circuitBreaker) rejecting() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.openDuration
+}
+
+// transition moves the circuit breaker to state, logging why along with the circuit breaker counters.
+// It must be called with mu held.
+func (b *circuitBreaker) transition(state circuitState, reason string) {
+	previous := b.state
+	b.state = state
+	b.probes, b.succeeded = 0, 0
+	switch state {
+	case circuitOpen:
+		b.openedAt = time.Now()
+		atomic.AddInt64(&b.metrics.circuitOpened, 1)
+	case circuitHalfOpen:
+		atomic.AddInt64(&b.metrics.circuitHalfOpened, 1)
+	case circuitClosed:
+		b.windowStart, b.requests, b.failures = time.Now(), 0, 0
+		atomic.AddInt64(&b.metrics.circuitClosed, 1)
+	}
+	atomic.StoreInt32(&b.metrics.circuitState, int32(state))
+
+	log.Printf("Circuit breaker %s -> %s: %s (opened=%d half_opened=%d closed=%d short_circuited=%d)",
+		previous, state, reason,
+		atomic.LoadInt64(&b.metrics.circuitOpened),
+		atomic.LoadInt64(&b.metrics.circuitHalfOpened),
+		atomic.LoadInt64(&b.metrics.circuitClosed),
+		atomic.LoadInt64(&b.metrics.shortCircuited),
+	)
+}
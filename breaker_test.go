@@ -0,0 +1,129 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestCircuitBreakerSpoolsWhileOpen(t *testing.T) {
+	logs := captureLog(t)
+	es := newFakeElasticsearch(t)
+	es.Fail("", http.StatusInternalServerError, http.StatusInternalServerError)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 1
+	cfg.FlushInterval = "10ms"
+	cfg.RetryServerErrorAttempts = 1
+	cfg.SpoolDirectory = t.TempDir()
+	cfg.CircuitBreakerFailureRate = 0.5
+	cfg.CircuitBreakerMinRequests = 2
+	cfg.CircuitBreakerOpenDuration = "100ms"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	for _, path := range []string{"/0", "/1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com"+path, nil))
+	}
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().CircuitBreakerOpened == 1 })
+	if state := elasticsearchLog.Metrics().CircuitBreakerState; state != traefik_plugin_elastic.CircuitOpen {
+		t.Fatalf("expected the circuit breaker to be open, got %s", state)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/2", nil))
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Spooled == 3 })
+
+	if metrics := elasticsearchLog.Metrics(); metrics.ShortCircuited != 1 || metrics.Failed != 0 {
+		t.Errorf("expected 1 short-circuited and no failed document, got %+v", metrics)
+	}
+	if requests := len(es.Refreshes()); requests != 2 {
+		t.Errorf("expected 2 bulk requests, got %d", requests)
+	}
+
+	// The next document is sent as a probe once the circuit breaker has been open long enough,
+	// and the spooled documents follow once it succeeds.
+	time.Sleep(150 * time.Millisecond)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/3", nil))
+
+	docs := es.WaitForDocuments(t, 4)
+	if len(docs) != 4 {
+		t.Fatalf("expected 4 documents, got %v", docs)
+	}
+
+	metrics := elasticsearchLog.Metrics()
+	if metrics.CircuitBreakerState != traefik_plugin_elastic.CircuitClosed {
+		t.Errorf("expected the circuit breaker to be closed, got %s", metrics.CircuitBreakerState)
+	}
+	if metrics.CircuitBreakerHalfOpened != 1 || metrics.CircuitBreakerClosed != 1 {
+		t.Errorf("expected the circuit breaker to close after one probe, got %+v", metrics)
+	}
+
+	expected := []string{
+		"Circuit breaker closed -> open: 2 of 2 requests to Elasticsearch failed within 10s (opened=1 half_opened=0 closed=0 short_circuited=0)",
+		"Circuit breaker open -> half-open: probing Elasticsearch after 100ms (opened=1 half_opened=1 closed=0 short_circuited=1)",
+		"Circuit breaker half-open -> closed: 1 probe requests to Elasticsearch succeeded (opened=1 half_opened=1 closed=1 short_circuited=1)",
+	}
+	lines := logs.Lines("Circuit breaker")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d transitions to be logged, got %q", len(expected), lines)
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, expected[i]) {
+			t.Errorf("expected %q to be logged, got %q", expected[i], line)
+		}
+	}
+}
+
+func TestCircuitBreakerReopensOnFailedProbe(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Fail("", http.StatusInternalServerError, http.StatusInternalServerError)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 1
+	cfg.RetryServerErrorAttempts = 1
+	cfg.CircuitBreakerFailureRate = 1
+	cfg.CircuitBreakerMinRequests = 1
+	cfg.CircuitBreakerOpenDuration = "50ms"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/0", nil))
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().CircuitBreakerOpened == 1 })
+
+	time.Sleep(100 * time.Millisecond)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/1", nil))
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().CircuitBreakerOpened == 2 })
+
+	// Without a spool, documents are dropped while the circuit breaker is open.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/2", nil))
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Failed == 3 })
+
+	metrics := elasticsearchLog.Metrics()
+	if metrics.CircuitBreakerHalfOpened != 1 || metrics.CircuitBreakerClosed != 0 || metrics.ShortCircuited != 1 {
+		t.Errorf("expected the failed probe to reopen the circuit breaker, got %+v", metrics)
+	}
+	if requests := len(es.Refreshes()); requests != 2 {
+		t.Errorf("expected 2 bulk requests, got %d", requests)
+	}
+}
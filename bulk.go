@@ -0,0 +1,608 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/google/uuid"
+)
+
+const (
+	// DocumentIDAuto lets Elasticsearch assign the document IDs.
+	DocumentIDAuto = "auto"
+	// DocumentIDUUID assigns a random UUID to each document.
+	DocumentIDUUID = "uuid"
+	// DocumentIDRequestID uses the request ID of the RequestIDHeader header, followed by a hash of the index
+	// and timestamp of the document, as document ID. The hash keeps a request ID reused by a client from
+	// making the document overwrite, or with the create action be dropped in favor of, another one.
+	DocumentIDRequestID = "request-id"
+	// DocumentIDHash uses the SHA-256 hash of the encoded document as document ID, so that a document
+	// delivered twice is only stored once.
+	DocumentIDHash = "hash"
+
+	// OpTypeIndex writes documents with the index action, replacing any document with the same ID.
+	OpTypeIndex = "index"
+	// OpTypeCreate writes documents with the create action, leaving any document with the same ID untouched.
+	OpTypeCreate = "create"
+
+	defaultDocumentID = DocumentIDUUID
+	defaultOpType     = OpTypeIndex
+
+	defaultFlushBytes     = 1 << 20
+	defaultFlushDocuments = 500
+	defaultFlushInterval  = "5s"
+	defaultRefresh        = "false"
+)
+
+// bulkItem is a document waiting to be written with the _bulk API.
+type bulkItem struct {
+	id       string
+	body     []byte
+	attempts int
+	// notBefore is when the item may be sent again after a failed attempt.
+	notBefore time.Time
+	// err is the error of the last failed attempt.
+	err deadLetterError
+	// class is the failure class of the last failed attempt.
+	class failureClass
+	// segment is the spool segment the item was read from, until it is released.
+	segment *spoolSegment
+}
+
+// failed records the error of a failed attempt to write the item.
+func (item *bulkItem) failed(class failureClass, status int, reason string) {
+	item.class = class
+	item.err = deadLetterError{Type: class.String(), Status: status, Reason: reason}
+}
+
+// bulkAction is the action line preceding each document in a _bulk request body.
+type bulkAction struct {
+	Index  *bulkActionMeta `json:"index,omitempty"`
+	Create *bulkActionMeta `json:"create,omitempty"`
+}
+
+type bulkActionMeta struct {
+	ID string `json:"_id,omitempty"`
+}
+
+// bulkResponse is the subset of the _bulk API response used to report per-item results.
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+// refreshPolicies are the values accepted by the refresh parameter of the Elasticsearch write APIs.
+var refreshPolicies = map[string]bool{
+	"false":    true,
+	"true":     true,
+	"wait_for": true,
+}
+
+// bulkOptions configures how a bulkIndexer writes documents.
+type bulkOptions struct {
+	encoder        encoder
+	index          string
+	documentID     string
+	opType         string
+	refresh        string
+	flushBytes     int
+	flushDocuments int
+	retry          retryPolicy
+	// maxRetryBytes bounds the size of the documents waiting to be retried by all the workers, counted
+	// in retryBytes.
+	maxRetryBytes int64
+	retryBytes    *int64
+	// deadLetters receives the documents given up on, if set.
+	deadLetters deadLetterSink
+}
+
+// newBulkOptions validates the bulk settings of config.
+func newBulkOptions(config *Config) (bulkOptions, error) {
+	opts := bulkOptions{
+		index:          config.IndexName,
+		documentID:     config.DocumentID,
+		opType:         config.OpType,
+		refresh:        config.Refresh,
+		flushBytes:     config.FlushBytes,
+		flushDocuments: config.FlushDocuments,
+		maxRetryBytes:  config.QueueMaxBytes,
+		retryBytes:     new(int64),
+	}
+	if opts.maxRetryBytes <= 0 {
+		opts.maxRetryBytes = defaultQueueMaxBytes
+	}
+	var err error
+	if opts.encoder, err = newEncoder(config.Schema, config.ECSVersion); err != nil {
+		return opts, err
+	}
+	if opts.documentID == "" {
+		opts.documentID = defaultDocumentID
+	}
+	switch opts.documentID {
+	case DocumentIDAuto, DocumentIDUUID, DocumentIDHash:
+	case DocumentIDRequestID:
+		if config.RequestIDHeader == "" {
+			return opts, fmt.Errorf("document ID strategy %q requires a request ID header", opts.documentID)
+		}
+	default:
+		return opts, fmt.Errorf("unknown document ID strategy %q", opts.documentID)
+	}
+	if opts.opType == "" {
+		opts.opType = defaultOpType
+	}
+	if opts.opType != OpTypeIndex && opts.opType != OpTypeCreate {
+		return opts, fmt.Errorf("invalid operation type %q: expected index or create", opts.opType)
+	}
+	if opts.refresh == "" {
+		opts.refresh = defaultRefresh
+	}
+	if !refreshPolicies[opts.refresh] {
+		return opts, fmt.Errorf("invalid refresh policy %q: expected false, true or wait_for", opts.refresh)
+	}
+	if opts.retry, err = newRetryPolicy(config); err != nil {
+		return opts, err
+	}
+	if opts.flushBytes <= 0 {
+		opts.flushBytes = defaultFlushBytes
+	}
+	if opts.flushDocuments <= 0 {
+		opts.flushDocuments = defaultFlushDocuments
+	}
+
+	return opts, nil
+}
+
+// bulkIndexer accumulates documents and writes them to Elasticsearch in NDJSON _bulk
+// requests once the flush size or document count is reached, or when flush is called.
+// A bulkIndexer is owned by a single pipeline worker and is not safe for concurrent use.
+type bulkIndexer struct {
+	transport esapi.Transport
+	opts      bulkOptions
+	metrics   *metrics
+	// spool receives the documents given up on after retryable failures, if set.
+	spool *spool
+	// breaker is the circuit breaker wrapping transport, if any.
+	breaker *circuitBreaker
+	// ctx bounds the bulk requests. It is canceled when the pipeline fails to stop in time.
+	ctx context.Context
+
+	items []*bulkItem
+	size  int
+	// retries are the items waiting for their backoff to elapse before being sent again, and
+	// retryAt is when the first of them is due.
+	retries []*bulkItem
+	retryAt time.Time
+}
+
+func newBulkIndexer(ctx context.Context, transport esapi.Transport, opts bulkOptions, m *metrics, s *spool) *bulkIndexer {
+	breaker, _ := transport.(*circuitBreaker)
+	return &bulkIndexer{
+		transport: transport,
+		opts:      opts,
+		metrics:   m,
+		spool:     s,
+		breaker:   breaker,
+		ctx:       ctx,
+	}
+}
+
+// add encodes doc with the configured schema and appends it to the pending batch, flushing the batch if it is full.
+func (b *bulkIndexer) add(doc *Document) {
+	body, err := b.opts.encoder.encode(doc)
+	if err != nil {
+		log.Printf("Error encoding the document: %s", err)
+		b.fail(1)
+		return
+	}
+
+	b.push(&bulkItem{id: b.documentID(doc, body), body: body})
+	if len(b.items) >= b.opts.flushDocuments || b.size >= b.opts.flushBytes {
+		b.flush()
+	}
+}
+
+// documentID returns the ID of doc, encoded as body, according to the document ID strategy.
+func (b *bulkIndexer) documentID(doc *Document, body []byte) string {
+	switch b.opts.documentID {
+	case DocumentIDAuto:
+		return ""
+	case DocumentIDHash:
+		sum := sha256.Sum256(body)
+		return hex.EncodeToString(sum[:])
+	case DocumentIDRequestID:
+		if doc.RequestID != "" {
+			sum := sha256.Sum256([]byte(b.opts.index + "\x00" + doc.Timestamp.UTC().Format(time.RFC3339Nano)))
+			return doc.RequestID + "-" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return uuid.New().String()
+}
+
+func (b *bulkIndexer) push(item *bulkItem) {
+	b.items = append(b.items, item)
+	b.size += len(item.body)
+}
+
+// flush writes the pending batch to Elasticsearch, along with the retried items whose backoff
+// has elapsed. Items that fail with a retryable error are kept for a later flush.
+func (b *bulkIndexer) flush() {
+	items := b.items
+	b.items = nil
+	b.size = 0
+
+	if len(b.retries) > 0 {
+		now := time.Now()
+		var waiting []*bulkItem
+		b.retryAt = time.Time{}
+		for _, item := range b.retries {
+			if item.notBefore.After(now) {
+				waiting = append(waiting, item)
+				b.scheduleRetry(item.notBefore)
+			} else {
+				items = append(items, item)
+				atomic.AddInt64(b.opts.retryBytes, -int64(len(item.body)))
+			}
+		}
+		b.retries = waiting
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	body, err := encodeBulkBody(items, b.opts.opType)
+	if err != nil {
+		log.Printf("Error encoding the bulk request: %s", err)
+		b.fail(len(items))
+		b.spool.release(items)
+		return
+	}
+
+	req := esapi.BulkRequest{
+		Index:   b.opts.index,
+		Body:    body,
+		Refresh: b.opts.refresh,
+	}
+
+	res, err := req.Do(b.ctx, b.transport)
+	if errors.Is(err, errCircuitOpen) {
+		b.metrics.setFailing(true)
+		for _, item := range items {
+			item.failed(failureConnection, 0, err.Error())
+		}
+		b.setAside(items, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Error sending the bulk request: %s", err)
+		b.metrics.setFailing(true)
+		for _, item := range items {
+			item.failed(failureConnection, 0, err.Error())
+		}
+		b.retry(items, 0)
+		return
+	}
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			log.Printf("Error closing the response body: %s", err)
+		}
+	}()
+
+	if res.IsError() {
+		reason := fmt.Sprintf("bulk request failed with status %s", res.Status())
+		log.Print(reason)
+		b.metrics.setFailing(true)
+		class := classifyStatus(res.StatusCode)
+		for _, item := range items {
+			item.failed(class, res.StatusCode, reason)
+		}
+		b.retry(items, parseRetryAfter(res.Header.Get("Retry-After"), time.Now()))
+		return
+	}
+	b.metrics.setFailing(false)
+
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		reason := fmt.Sprintf("error parsing the bulk response body: %s", err)
+		log.Print(reason)
+		for _, item := range items {
+			item.failed(failureConnection, 0, reason)
+		}
+		b.retry(items, 0)
+		return
+	}
+	if !r.Errors {
+		atomic.AddInt64(&b.metrics.indexed, int64(len(items)))
+		b.spool.release(items)
+		return
+	}
+
+	b.handleItemErrors(items, r.Items)
+}
+
+// handleItemErrors reports the items of a partially failed _bulk request and keeps the
+// retryable ones for a later flush. Results are returned in the order of the request.
+func (b *bulkIndexer) handleItemErrors(items []*bulkItem, results []map[string]bulkResponseItem) {
+	if len(results) != len(items) {
+		log.Printf("Error: bulk response has %d items, expected %d", len(results), len(items))
+		b.fail(len(items))
+		b.spool.release(items)
+		return
+	}
+
+	var indexed, failed []*bulkItem
+	for i, result := range results {
+		for _, res := range result {
+			// With the create operation, a conflict means that the document was already delivered.
+			if res.Status < http.StatusMultipleChoices || (res.Status == http.StatusConflict && b.opts.opType == OpTypeCreate) {
+				atomic.AddInt64(&b.metrics.indexed, 1)
+				indexed = append(indexed, items[i])
+				continue
+			}
+
+			reason := fmt.Sprintf("status %d", res.Status)
+			if res.Error != nil {
+				reason = fmt.Sprintf("%s: %s", res.Error.Type, res.Error.Reason)
+			}
+			items[i].failed(classifyStatus(res.Status), res.Status, reason)
+			failed = append(failed, items[i])
+		}
+	}
+
+	b.spool.release(indexed)
+	b.retry(failed, 0)
+}
+
+// retry schedules the failed items for a later flush, after a backoff of at least retryAfter, unless
+// the retry policy of their failure class gives up on them. Items given up on after transient
+// failures are spooled if possible, and the others are sent to the dead-letter destination.
+// Items that would make the retried documents exceed maxRetryBytes are spooled, or dropped without
+// a spool.
+func (b *bulkIndexer) retry(items []*bulkItem, retryAfter time.Duration) {
+	var spooled, abandoned, overflow []*bulkItem
+	now := time.Now()
+	for _, item := range items {
+		item.attempts++
+		switch {
+		case b.opts.retry.retries(item.class, item.attempts):
+			if !b.reserveRetry(int64(len(item.body))) {
+				overflow = append(overflow, item)
+				continue
+			}
+			item.notBefore = now.Add(b.opts.retry.backoff(item.attempts, retryAfter))
+			b.retries = append(b.retries, item)
+			b.scheduleRetry(item.notBefore)
+		case b.spool != nil && item.class != failureClientError:
+			spooled = append(spooled, item)
+		default:
+			abandoned = append(abandoned, item)
+		}
+	}
+
+	if len(spooled) > 0 {
+		log.Printf("Spooling %d documents after %d attempts: %s", len(spooled), spooled[0].attempts, spooled[0].err.Reason)
+		b.spool.append(spooled)
+		b.spool.release(spooled)
+	}
+	b.abandon(abandoned)
+
+	if len(overflow) > 0 {
+		if b.spool != nil {
+			b.setAside(overflow, "too many documents are waiting to be retried")
+		} else {
+			b.dropRetries(overflow)
+		}
+	}
+}
+
+// reserveRetry adds size to the retried bytes if they stay within maxRetryBytes, and reports whether it did.
+func (b *bulkIndexer) reserveRetry(size int64) bool {
+	for {
+		current := atomic.LoadInt64(b.opts.retryBytes)
+		if current+size > b.opts.maxRetryBytes {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(b.opts.retryBytes, current, current+size) {
+			return true
+		}
+	}
+}
+
+// dropRetries drops items that cannot be retried because too many documents are waiting to be.
+func (b *bulkIndexer) dropRetries(items []*bulkItem) {
+	atomic.AddInt64(&b.metrics.droppedRetries, int64(len(items)))
+	atomic.AddInt64(&b.metrics.dropped, int64(len(items)))
+	b.metrics.logDropped("too many documents are waiting to be retried")
+	b.spool.release(items)
+}
+
+// scheduleRetry makes retryAt no later than at.
+func (b *bulkIndexer) scheduleRetry(at time.Time) {
+	if b.retryAt.IsZero() || at.Before(b.retryAt) {
+		b.retryAt = at
+	}
+}
+
+// nextRetry returns when the first retried item is due, or the zero time when there is none.
+func (b *bulkIndexer) nextRetry() time.Time {
+	return b.retryAt
+}
+
+// setAside spools items, or gives up on them when there is no spool, without retrying them: the
+// circuit breaker is open, or the pipeline is stopping.
+func (b *bulkIndexer) setAside(items []*bulkItem, reason string) {
+	if b.spool != nil {
+		log.Printf("Spooling %d documents: %s", len(items), reason)
+		b.spool.append(items)
+		b.spool.release(items)
+		return
+	}
+	b.abandon(items)
+}
+
+// close flushes the pending batch along with every retried item, regardless of its backoff, and
+// sets aside the items that failed again.
+func (b *bulkIndexer) close() {
+	for _, item := range b.retries {
+		item.notBefore = time.Time{}
+	}
+	b.flush()
+
+	if len(b.retries) > 0 {
+		items := b.retries
+		b.retries, b.retryAt = nil, time.Time{}
+		for _, item := range items {
+			atomic.AddInt64(b.opts.retryBytes, -int64(len(item.body)))
+		}
+		b.setAside(items, "the middleware is shut down")
+	}
+}
+
+// abandon gives up on items, sending them to the dead-letter destination if there is one.
+func (b *bulkIndexer) abandon(items []*bulkItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	letters := make([]*deadLetter, 0, len(items))
+	for _, item := range items {
+		if item.err.Status != 0 {
+			log.Printf("[%d] Error indexing document ID=%s after %d attempts: %s", item.err.Status, item.id, item.attempts, item.err.Reason)
+		} else {
+			log.Printf("Dropping document ID=%s after %d attempts: %s", item.id, item.attempts, item.err.Reason)
+		}
+		letters = append(letters, &deadLetter{
+			Timestamp: time.Now().UTC(),
+			Index:     b.opts.index,
+			ID:        item.id,
+			Attempts:  item.attempts,
+			Error:     item.err,
+			Document:  string(item.body),
+		})
+	}
+	b.fail(len(items))
+	defer b.spool.release(items)
+
+	if b.opts.deadLetters == nil {
+		return
+	}
+	if err := b.opts.deadLetters.write(b.ctx, letters); err != nil {
+		log.Printf("Error writing %d dead letters: %s", len(letters), err)
+		return
+	}
+	atomic.AddInt64(&b.metrics.deadLettered, int64(len(letters)))
+}
+
+// drain sends the documents of the oldest spool segment. Documents that fail again are retried
+// and spooled anew, and the segment is deleted once none of them is pending. It reports whether a
+// segment was read, which it is not while the circuit breaker is open.
+func (b *bulkIndexer) drain() bool {
+	if b.breaker.rejecting() {
+		return false
+	}
+	items := b.spool.next()
+	if items == nil {
+		return false
+	}
+
+	for _, item := range items {
+		b.push(item)
+		if len(b.items) >= b.opts.flushDocuments || b.size >= b.opts.flushBytes {
+			b.flush()
+		}
+	}
+	b.flush()
+	return true
+}
+
+// probeBody is the _bulk request body of probes. Deleting a document that does not exist goes through
+// the bulk endpoint of the index without changing it.
+const probeBody = `{"delete":{"_id":"traefik-plugin-elastic-probe"}}` + "\n"
+
+// probe sends a bulk request to the index while deliveries are failing and nothing is pending, and
+// clears the failing state once it is accepted. Flushes clear it as well, but fail-closed instances
+// queue no document while it is set, so without probes they would never recover. Probes bypass the
+// circuit breaker, which only accounts for the requests carrying documents.
+func (b *bulkIndexer) probe() {
+	if !b.metrics.isFailing() || len(b.items) > 0 || len(b.retries) > 0 {
+		return
+	}
+
+	transport := b.transport
+	if b.breaker != nil {
+		transport = b.breaker.transport
+	}
+	req := esapi.BulkRequest{Index: b.opts.index, Body: strings.NewReader(probeBody)}
+	res, err := req.Do(b.ctx, transport)
+	if err != nil {
+		return
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return
+	}
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return
+	}
+	for _, results := range r.Items {
+		for _, result := range results {
+			if result.Status == http.StatusTooManyRequests || result.Status >= http.StatusInternalServerError {
+				return
+			}
+		}
+	}
+	log.Print("Elasticsearch accepts bulk requests again")
+	b.metrics.setFailing(false)
+}
+
+// fail counts n documents that will never be indexed.
+func (b *bulkIndexer) fail(n int) {
+	failed := atomic.AddInt64(&b.metrics.failed, int64(n))
+	log.Printf("%d documents could not be indexed so far", failed)
+}
+
+func encodeBulkBody(items []*bulkItem, opType string) (io.Reader, error) {
+	var buf bytes.Buffer
+	for _, item := range items {
+		var a bulkAction
+		if opType == OpTypeCreate {
+			a.Create = &bulkActionMeta{ID: item.id}
+		} else {
+			a.Index = &bulkActionMeta{ID: item.id}
+		}
+		action, err := json.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(action)
+		buf.WriteByte('\n')
+		buf.Write(item.body)
+		buf.WriteByte('\n')
+	}
+	return &buf, nil
+}
@@ -0,0 +1,77 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBulkIndexerBoundsRetries(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		spool          bool
+		droppedRetries int64
+		spooled        int64
+	}{
+		{desc: "without a spool", droppedRetries: 2},
+		{desc: "with a spool", spool: true, spooled: 2},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			policy, err := newRetryPolicy(&Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &metrics{}
+			b := &bulkIndexer{
+				opts:      bulkOptions{retry: policy, maxRetryBytes: 25, retryBytes: new(int64)},
+				metrics:   m,
+				transport: failingTransport{},
+				ctx:       context.Background(),
+			}
+			if test.spool {
+				if b.spool, err = newSpool(t.TempDir(), 0, 0, time.Hour, ""); err != nil {
+					t.Fatal(err)
+				}
+				m.spool = b.spool
+				defer b.spool.close()
+			}
+
+			items := make([]*bulkItem, 4)
+			for i := range items {
+				items[i] = &bulkItem{body: []byte(`{"n":12345}`)}
+				items[i].failed(failureConnection, 0, "unreachable")
+			}
+			b.retry(items, 0)
+
+			if len(b.retries) != 2 || *b.opts.retryBytes != 22 {
+				t.Errorf("expected 2 retried documents holding 22 bytes, got %d holding %d", len(b.retries), *b.opts.retryBytes)
+			}
+			if got := m.snapshot(); got.DroppedRetries != test.droppedRetries || got.Dropped != test.droppedRetries || got.Spooled != test.spooled || got.Failed != 0 {
+				t.Errorf("expected %d dropped and %d spooled documents, got %+v", test.droppedRetries, test.spooled, got)
+			}
+
+			// Retries leaving the buffer make room for new ones.
+			for _, item := range b.retries {
+				item.notBefore = time.Time{}
+			}
+			b.flush()
+			if len(b.retries) != 2 || *b.opts.retryBytes != 22 {
+				t.Errorf("expected the failed retries to be retried again, got %d holding %d", len(b.retries), *b.opts.retryBytes)
+			}
+		})
+	}
+}
+
+// failingTransport fails every request as if Elasticsearch could not be reached.
+type failingTransport struct{}
+
+func (failingTransport) Perform(*http.Request) (*http.Response, error) {
+	return nil, errors.New("unreachable")
+}
@@ -0,0 +1,195 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestBulkRetriesOnlyRetryableItems(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Reject(http.StatusTooManyRequests, http.StatusBadRequest)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 2
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for _, path := range []string{"/retryable", "/rejected", "/accepted"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com"+path, nil))
+	}
+
+	// The first batch holds /retryable and /rejected; /retryable is kept and flushed
+	// again once its backoff has elapsed.
+	es.WaitForDocuments(t, 2)
+	time.Sleep(50 * time.Millisecond)
+
+	docs := es.Documents()
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 indexed documents, got %d", len(docs))
+	}
+	paths := map[interface{}]bool{}
+	for _, doc := range docs {
+		paths[doc["path"]] = true
+	}
+	if !paths["/retryable"] || !paths["/accepted"] {
+		t.Errorf("expected /retryable and /accepted to be indexed, got %v", paths)
+	}
+}
+
+func TestBulkRefreshPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		refresh  string
+		expected string
+	}{
+		{desc: "default", expected: "false"},
+		{desc: "wait_for", refresh: "wait_for", expected: "wait_for"},
+		{desc: "true", refresh: "true", expected: "true"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.Refresh = test.refresh
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+			es.WaitForDocuments(t, 1)
+
+			refreshes := es.Refreshes()
+			if len(refreshes) != 1 || refreshes[0] != test.expected {
+				t.Errorf("expected refresh=%s, got %v", test.expected, refreshes)
+			}
+		})
+	}
+}
+
+func TestBulkDocumentID(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		documentID string
+		opType     string
+		expected   *regexp.Regexp
+	}{
+		{desc: "default", expected: regexp.MustCompile(`^index:[0-9a-f-]{36}$`)},
+		{desc: "auto", documentID: traefik_plugin_elastic.DocumentIDAuto, expected: regexp.MustCompile(`^index:$`)},
+		{desc: "uuid", documentID: traefik_plugin_elastic.DocumentIDUUID, opType: traefik_plugin_elastic.OpTypeCreate, expected: regexp.MustCompile(`^create:[0-9a-f-]{36}$`)},
+		{desc: "request ID", documentID: traefik_plugin_elastic.DocumentIDRequestID, expected: regexp.MustCompile(`^index:req-1-[0-9a-f]{16}$`)},
+		{desc: "hash", documentID: traefik_plugin_elastic.DocumentIDHash, expected: regexp.MustCompile(`^index:[0-9a-f]{64}$`)},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.DocumentID = test.documentID
+			cfg.OpType = test.opType
+			cfg.RequestIDHeader = "X-Request-ID"
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			req.Header.Set("X-Request-ID", "req-1")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			es.WaitForDocuments(t, 1)
+			actions := es.Actions()
+			if len(actions) != 1 || !test.expected.MatchString(actions[0]) {
+				t.Errorf("expected an action matching %s, got %v", test.expected, actions)
+			}
+		})
+	}
+}
+
+func TestBulkDocumentIDGeneratedRequestID(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.DocumentID = traefik_plugin_elastic.DocumentIDRequestID
+	cfg.RequestIDHeader = "X-Request-ID"
+
+	var requestID string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get("X-Request-ID")
+	})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+
+	es.WaitForDocuments(t, 1)
+	if actions := es.Actions(); len(actions) != 1 || !strings.HasPrefix(actions[0], "index:"+requestID+"-") {
+		t.Errorf("expected the generated request ID %q as document ID, got %v", requestID, actions)
+	}
+}
+
+func TestBulkCreateIgnoresReusedClientRequestIDs(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.DocumentID = traefik_plugin_elastic.DocumentIDRequestID
+	cfg.OpType = traefik_plugin_elastic.OpTypeCreate
+	cfg.RequestIDHeader = "X-Request-ID"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Indexed == 2 })
+
+	docs := es.Documents()
+	if len(docs) != 2 {
+		t.Fatalf("expected both documents to be stored, got %d", len(docs))
+	}
+	for _, doc := range docs {
+		if got := doc["request_id"]; got != "req-1" {
+			t.Errorf("expected the client request ID to be logged, got %v", got)
+		}
+	}
+}
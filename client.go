@@ -0,0 +1,113 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+const (
+	defaultMaxIdleConnections = 10
+	defaultIdleConnTimeout    = "90s"
+	defaultDialTimeout        = "5s"
+	defaultResponseTimeout    = "30s"
+	defaultKeepAlive          = "30s"
+)
+
+// transportOptions holds the connection settings of the HTTP transport shared by the
+// requests a middleware instance sends to Elasticsearch.
+type transportOptions struct {
+	verifyTLS          bool
+	maxConnections     int
+	maxIdleConnections int
+	idleConnTimeout    time.Duration
+	dialTimeout        time.Duration
+	responseTimeout    time.Duration
+	keepAlive          time.Duration
+}
+
+// newTransportOptions validates the connection settings of config.
+func newTransportOptions(config *Config) (transportOptions, error) {
+	opts := transportOptions{
+		verifyTLS:          config.VerifyTLS,
+		maxConnections:     config.MaxConnections,
+		maxIdleConnections: config.MaxIdleConnections,
+	}
+	if opts.maxConnections < 0 {
+		return opts, fmt.Errorf("invalid maximum number of connections: %d", opts.maxConnections)
+	}
+	if opts.maxIdleConnections <= 0 {
+		opts.maxIdleConnections = defaultMaxIdleConnections
+	}
+
+	var err error
+	if opts.idleConnTimeout, err = parseDuration(config.IdleConnTimeout, defaultIdleConnTimeout); err != nil {
+		return opts, fmt.Errorf("invalid idle connection timeout: %w", err)
+	}
+	if opts.dialTimeout, err = parseDuration(config.DialTimeout, defaultDialTimeout); err != nil {
+		return opts, fmt.Errorf("invalid dial timeout: %w", err)
+	}
+	if opts.responseTimeout, err = parseDuration(config.ResponseTimeout, defaultResponseTimeout); err != nil {
+		return opts, fmt.Errorf("invalid response timeout: %w", err)
+	}
+	if opts.keepAlive, err = parseDuration(config.KeepAlive, defaultKeepAlive); err != nil {
+		return opts, fmt.Errorf("invalid keep-alive period: %w", err)
+	}
+
+	return opts, nil
+}
+
+// newTransport creates the pooled HTTP transport used to reach Elasticsearch.
+func newTransport(opts transportOptions) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   opts.dialTimeout,
+		KeepAlive: opts.keepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxConnsPerHost:       opts.maxConnections,
+		MaxIdleConns:          opts.maxIdleConnections,
+		MaxIdleConnsPerHost:   opts.maxIdleConnections,
+		IdleConnTimeout:       opts.idleConnTimeout,
+		TLSHandshakeTimeout:   opts.dialTimeout,
+		ResponseHeaderTimeout: opts.responseTimeout,
+		// Skipping certificate verification is only done when VerifyTLS is explicitly disabled.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: !opts.verifyTLS}, //nolint:gosec
+	}
+}
+
+// newClient creates the Elasticsearch client of a middleware instance.
+func newClient(config *Config) (*elasticsearch.Client, error) {
+	u, err := url.Parse(config.ElasticsearchURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Elasticsearch URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Elasticsearch URL %q: expected http(s)://host[:port]", config.ElasticsearchURL)
+	}
+
+	opts, err := newTransportOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return elasticsearch.NewClient(elasticsearch.Config{
+		Addresses: []string{
+			config.ElasticsearchURL,
+		},
+		Username:  config.Username,
+		Password:  config.Password,
+		APIKey:    config.APIKey,
+		Transport: newTransport(opts),
+	})
+}
@@ -0,0 +1,159 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+
+	defaultForwardedHeader = headerXForwardedFor
+)
+
+// clientIPResolver finds the address of the client that originated a request, walking the
+// forwarding header set by trusted proxies.
+type clientIPResolver struct {
+	trusted []*net.IPNet
+	// header is the forwarding header the trusted proxies write. Other forwarding headers are
+	// ignored, since clients can set them and trusted proxies pass them through.
+	header string
+}
+
+// newClientIPResolver creates a resolver trusting the given IP addresses and CIDR ranges, which
+// write the forwarding header named header.
+func newClientIPResolver(trustedProxies []string, header string) (*clientIPResolver, error) {
+	if header == "" {
+		header = defaultForwardedHeader
+	}
+	header = http.CanonicalHeaderKey(header)
+	switch header {
+	case headerForwarded, headerXForwardedFor, http.CanonicalHeaderKey(headerXRealIP):
+	default:
+		return nil, fmt.Errorf("unknown forwarded header %q: expected X-Forwarded-For, Forwarded or X-Real-IP", header)
+	}
+
+	r := &clientIPResolver{header: header}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			r.trusted = append(r.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+
+	return r, nil
+}
+
+// resolve returns the client IP of req and the raw forwarding chain it was read from.
+// The forwarding header is only considered when the peer is a trusted proxy; it is then
+// walked right to left, stopping at the first hop that is not trusted.
+func (r *clientIPResolver) resolve(req *http.Request) (string, []string) {
+	peer, _ := splitHostPort(req.RemoteAddr)
+	if !r.isTrusted(net.ParseIP(peer)) {
+		return peer, nil
+	}
+
+	chain := forwardingChain(req.Header, r.header)
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// Obfuscated or malformed hops cannot be checked, so the walk stops at the
+			// last proxy known to be trusted.
+			break
+		}
+		client = ip.String()
+		if !r.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client, chain
+}
+
+func (r *clientIPResolver) isTrusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardingChain returns the addresses of the hops listed by the forwarding header named header,
+// from the client to the closest proxy.
+func forwardingChain(h http.Header, header string) []string {
+	switch header {
+	case headerForwarded:
+		return parseForwarded(h.Values(headerForwarded))
+	case headerXForwardedFor:
+		var chain []string
+		for _, value := range h.Values(headerXForwardedFor) {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					chain = append(chain, stripPort(hop))
+				}
+			}
+		}
+		return chain
+	default:
+		if value := strings.TrimSpace(h.Get(header)); value != "" {
+			return []string{stripPort(value)}
+		}
+		return nil
+	}
+}
+
+// parseForwarded extracts the "for" parameters of RFC 7239 Forwarded header values.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if !found || !strings.EqualFold(key, "for") {
+					continue
+				}
+				chain = append(chain, stripPort(strings.Trim(val, `"`)))
+			}
+		}
+	}
+	return chain
+}
+
+// stripPort removes the port and IPv6 brackets from a hop address such as "[2001:db8::1]:4711".
+func stripPort(hop string) string {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return host
+	}
+	return strings.Trim(hop, "[]")
+}
@@ -0,0 +1,133 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientIPResolverResolve(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		header        string
+		remoteAddr    string
+		headers       map[string]string
+		expectedIP    string
+		expectedChain []string
+	}{
+		{
+			desc:       "no forwarding headers",
+			remoteAddr: "10.0.0.1:1234",
+			expectedIP: "10.0.0.1",
+		},
+		{
+			desc:       "spoofed headers from an untrusted peer",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			desc:          "X-Forwarded-For stops at the first untrusted hop",
+			remoteAddr:    "10.0.0.1:1234",
+			headers:       map[string]string{"X-Forwarded-For": "198.51.100.9, 203.0.113.7, 10.0.0.2"},
+			expectedIP:    "203.0.113.7",
+			expectedChain: []string{"198.51.100.9", "203.0.113.7", "10.0.0.2"},
+		},
+		{
+			desc:          "all hops trusted",
+			remoteAddr:    "10.0.0.1:1234",
+			headers:       map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			expectedIP:    "10.0.0.3",
+			expectedChain: []string{"10.0.0.3", "10.0.0.2"},
+		},
+		{
+			desc:          "hop with a port",
+			remoteAddr:    "10.0.0.1:1234",
+			headers:       map[string]string{"X-Forwarded-For": "203.0.113.7:4711"},
+			expectedIP:    "203.0.113.7",
+			expectedChain: []string{"203.0.113.7"},
+		},
+		{
+			desc:       "Forwarded spoofed through a proxy appending X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded":       "for=1.2.3.4",
+				"X-Forwarded-For": "203.0.113.7",
+			},
+			expectedIP:    "203.0.113.7",
+			expectedChain: []string{"203.0.113.7"},
+		},
+		{
+			desc:       "Forwarded spoofed without X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=1.2.3.4"},
+			expectedIP: "10.0.0.1",
+		},
+		{
+			desc:       "Forwarded written by the trusted proxies",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2;by=10.0.0.1`,
+				"X-Forwarded-For": "203.0.113.7",
+			},
+			expectedIP:    "2001:db8:cafe::17",
+			expectedChain: []string{"2001:db8:cafe::17", "10.0.0.2"},
+		},
+		{
+			desc:          "obfuscated hop",
+			header:        "Forwarded",
+			remoteAddr:    "10.0.0.1:1234",
+			headers:       map[string]string{"Forwarded": "for=_hidden, for=10.0.0.2"},
+			expectedIP:    "10.0.0.2",
+			expectedChain: []string{"_hidden", "10.0.0.2"},
+		},
+		{
+			desc:          "X-Real-IP",
+			header:        "X-Real-IP",
+			remoteAddr:    "10.0.0.1:1234",
+			headers:       map[string]string{"X-Real-IP": "203.0.113.7", "X-Forwarded-For": "1.2.3.4"},
+			expectedIP:    "203.0.113.7",
+			expectedChain: []string{"203.0.113.7"},
+		},
+		{
+			desc:       "X-Real-IP spoofed through a proxy appending X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Real-IP": "1.2.3.4"},
+			expectedIP: "10.0.0.1",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			r, err := newClientIPResolver([]string{"10.0.0.0/8", "192.0.2.254"}, test.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			req.RemoteAddr = test.remoteAddr
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			ip, chain := r.resolve(req)
+			if ip != test.expectedIP {
+				t.Errorf("expected client IP %s, got %s", test.expectedIP, ip)
+			}
+			if !reflect.DeepEqual(chain, test.expectedChain) {
+				t.Errorf("expected forwarding chain %v, got %v", test.expectedChain, chain)
+			}
+		})
+	}
+}
+
+func TestNewClientIPResolverRejectsUnknownHeaders(t *testing.T) {
+	if _, err := newClientIPResolver(nil, "True-Client-IP"); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestClientIPResolution(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.ForwardedHeader = "Forwarded"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", "for=203.0.113.7, for=10.0.0.2")
+	req.Header.Set("X-Forwarded-For", "198.51.100.9")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 indexed document, got %d", len(docs))
+	}
+
+	if got := docs[0]["client_ip"]; got != "203.0.113.7" {
+		t.Errorf("expected client IP 203.0.113.7, got %v", got)
+	}
+	if got, expected := docs[0]["forwarded_for"], []interface{}{"203.0.113.7", "10.0.0.2"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected forwarding chain %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,132 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// deadLetter is a document given up on, with the last error it failed with. The document is kept
+// as a string, since it may not match the mapping of the dead-letter index.
+type deadLetter struct {
+	Timestamp time.Time       `json:"@timestamp"`
+	Index     string          `json:"index"`
+	ID        string          `json:"id,omitempty"`
+	Attempts  int             `json:"attempts"`
+	Error     deadLetterError `json:"error"`
+	Document  string          `json:"document"`
+}
+
+type deadLetterError struct {
+	// Type is the failure class of the last attempt.
+	Type   string `json:"type"`
+	Status int    `json:"status,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// deadLetterSink stores the documents given up on.
+type deadLetterSink interface {
+	write(ctx context.Context, letters []*deadLetter) error
+	close() error
+}
+
+// newDeadLetterSink returns the dead-letter destination of config, or nil when there is none. Dead letters
+// are sent through transport directly rather than through the circuit breaker, so that they are not lost
+// while it is open.
+func newDeadLetterSink(config *Config, transport esapi.Transport) (deadLetterSink, error) {
+	switch {
+	case config.DeadLetterIndex != "" && config.DeadLetterFile != "":
+		return nil, errors.New("only one of the dead-letter index and file can be set")
+	case config.DeadLetterIndex != "":
+		return &deadLetterIndex{transport: transport, index: config.DeadLetterIndex}, nil
+	case config.DeadLetterFile != "":
+		f, err := os.OpenFile(config.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the dead-letter file: %w", err)
+		}
+		return &deadLetterFile{file: f}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// deadLetterIndex writes dead letters to an Elasticsearch index.
+type deadLetterIndex struct {
+	transport esapi.Transport
+	index     string
+}
+
+func (d *deadLetterIndex) write(ctx context.Context, letters []*deadLetter) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, letter := range letters {
+		body.WriteString(`{"create":{}}` + "\n")
+		if err := encoder.Encode(letter); err != nil {
+			return err
+		}
+	}
+
+	req := esapi.BulkRequest{Index: d.index, Body: &body}
+	res, err := req.Do(ctx, d.transport)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.IsError() {
+		return fmt.Errorf("bulk request failed with status %s", res.Status())
+	}
+	var r bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("error parsing the bulk response body: %w", err)
+	}
+	if r.Errors {
+		return errors.New("some dead letters were rejected")
+	}
+	return nil
+}
+
+func (d *deadLetterIndex) close() error {
+	return nil
+}
+
+// deadLetterFile appends dead letters to a local NDJSON file. It is shared by the pipeline workers.
+type deadLetterFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (d *deadLetterFile) write(_ context.Context, letters []*deadLetter) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, letter := range letters {
+		if err := encoder.Encode(letter); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+func (d *deadLetterFile) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.file.Close()
+}
@@ -0,0 +1,170 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Document is the log entry indexed into Elasticsearch for a single HTTP request.
+type Document struct {
+	// Timestamp is the time at which the middleware received the request.
+	Timestamp time.Time `json:"@timestamp"`
+	// Message is the log message rendered from the Message template of the middleware.
+	Message string `json:"message"`
+	// Method is the HTTP method of the request (GET, POST, ...).
+	Method string `json:"method"`
+	// Scheme is the URL scheme the client used to reach Traefik (http or https).
+	Scheme string `json:"scheme"`
+	// Host is the value of the Host header, or the host of the request URL.
+	Host string `json:"host"`
+	// Path is the path of the request URL.
+	Path string `json:"path"`
+	// Query is the raw, still encoded, query string of the request URL.
+	Query string `json:"query,omitempty"`
+	// Protocol is the protocol version of the request, for example HTTP/1.1.
+	Protocol string `json:"protocol"`
+	// RemoteAddr is the network address of the peer that sent the request.
+	RemoteAddr string `json:"remote_addr"`
+	// ClientIP is the address of the client that originated the request, resolved through the
+	// forwarding headers set by trusted proxies.
+	ClientIP string `json:"client_ip,omitempty"`
+	// ForwardedFor is the forwarding chain the client IP was resolved from, from the client to
+	// the closest proxy.
+	ForwardedFor []string `json:"forwarded_for,omitempty"`
+	// Geo is the location of the client IP, found in the configured GeoIP databases.
+	Geo *Geo `json:"geo,omitempty"`
+	// AS is the autonomous system of the client IP, found in the configured GeoIP databases.
+	AS *AS `json:"as,omitempty"`
+	// UserAgent is the value of the User-Agent header.
+	UserAgent string `json:"user_agent,omitempty"`
+	// UserAgentDetails is the parsed form of UserAgent.
+	UserAgentDetails *UserAgent `json:"user_agent_details,omitempty"`
+	// User is the authenticated user of the request.
+	User *User `json:"user,omitempty"`
+	// GraphQL describes the operations of GraphQL requests, one per operation of a batch.
+	GraphQL []GraphQLOperation `json:"graphql,omitempty"`
+	// RequestID is the ID of the request, read from or set in the configured request ID header.
+	RequestID string `json:"request_id,omitempty"`
+	// Trace is the W3C Trace Context trace the request belongs to.
+	Trace *Identifier `json:"trace,omitempty"`
+	// Parent is the span of the caller in the trace, when the request carries a traceparent header.
+	Parent *Identifier `json:"parent,omitempty"`
+	// Transaction is the handling of the request by the middleware, which is the parent of the
+	// upstream request in the trace.
+	Transaction *Identifier `json:"transaction,omitempty"`
+	// Span is the span of the middleware in the trace. It has the same ID as Transaction.
+	Span *Identifier `json:"span,omitempty"`
+	// Referer is the value of the Referer header.
+	Referer string `json:"referer,omitempty"`
+	// ContentLength is the length of the request body, or -1 if it is unknown.
+	ContentLength int64 `json:"content_length"`
+	// RequestHeaders are the captured request headers, keyed by their lowercase name.
+	RequestHeaders map[string]string `json:"request_headers,omitempty"`
+	// RequestBody is the captured beginning of the request body.
+	RequestBody *Body `json:"request_body,omitempty"`
+	// Status is the status code of the response sent to the client.
+	Status int `json:"status"`
+	// ResponseHeaders are the captured response headers, keyed by their lowercase name.
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	// ResponseBody is the captured beginning of the response body, decompressed if needed.
+	ResponseBody *Body `json:"response_body,omitempty"`
+	// BytesSent is the number of response body bytes written to the client.
+	BytesSent int64 `json:"bytes_sent"`
+	// TimeToFirstByte is the time, in nanoseconds, between receiving the request and writing
+	// the first byte of the response.
+	TimeToFirstByte time.Duration `json:"time_to_first_byte"`
+	// Duration is the time, in nanoseconds, taken by the downstream handlers to serve the request.
+	Duration time.Duration `json:"duration"`
+}
+
+// NewDocument builds a Document describing req.
+func NewDocument(req *http.Request, message string, now time.Time) *Document {
+	return &Document{
+		Timestamp:     now.UTC(),
+		Message:       message,
+		Method:        req.Method,
+		Scheme:        requestScheme(req),
+		Host:          requestHost(req),
+		Path:          req.URL.Path,
+		Query:         req.URL.RawQuery,
+		Protocol:      req.Proto,
+		RemoteAddr:    req.RemoteAddr,
+		UserAgent:     req.UserAgent(),
+		Referer:       req.Referer(),
+		ContentLength: req.ContentLength,
+	}
+}
+
+// setResponse fills the response fields of the document from rec, once the downstream
+// handlers have returned.
+func (d *Document) setResponse(rec *responseRecorder, now time.Time) {
+	d.Status = rec.status
+	d.BytesSent = rec.size
+	d.TimeToFirstByte = rec.timeToFirstByte()
+	d.Duration = now.Sub(rec.start)
+}
+
+// JSON returns the JSON encoding of the document.
+func (d *Document) JSON() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// documentOverhead approximates the memory used by a Document besides its variable-length fields.
+const documentOverhead = 512
+
+// size estimates the memory used by the document, to bound the memory held by the pipeline queue.
+func (d *Document) size() int64 {
+	n := documentOverhead + len(d.Message) + len(d.Method) + len(d.Scheme) + len(d.Host) + len(d.Path) +
+		len(d.Query) + len(d.Protocol) + len(d.RemoteAddr) + len(d.ClientIP) + len(d.UserAgent) +
+		len(d.RequestID) + len(d.Referer)
+	for _, hop := range d.ForwardedFor {
+		n += len(hop)
+	}
+	for _, headers := range []map[string]string{d.RequestHeaders, d.ResponseHeaders} {
+		for name, value := range headers {
+			n += len(name) + len(value)
+		}
+	}
+	for _, body := range []*Body{d.RequestBody, d.ResponseBody} {
+		if body != nil {
+			n += len(body.Content)
+		}
+	}
+	for _, op := range d.GraphQL {
+		n += len(op.Name) + len(op.QueryHash) + len(op.PersistedQueryHash)
+		for _, field := range op.Fields {
+			n += len(field)
+		}
+		// Variables are only estimated: measuring them would mean encoding them.
+		n += 64 * len(op.Variables)
+	}
+	if d.User != nil {
+		n += len(d.User.ID) + len(d.User.Name) + len(d.User.FullName) + len(d.User.Email) + len(d.User.Domain) +
+			64*len(d.User.Claims)
+		for _, role := range d.User.Roles {
+			n += len(role)
+		}
+	}
+	return int64(n)
+}
@@ -0,0 +1,53 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestNewDocument(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://test.com/foo?bar=baz", strings.NewReader("hello"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+
+	now := time.Date(2023, 6, 23, 10, 0, 0, 0, time.UTC)
+	doc := traefik_plugin_elastic.NewDocument(req, "Test Elasticsearch", now)
+
+	data, err := doc.JSON()
+	if err != nil {
+		t.Fatalf("Could not encode document: %v", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Could not decode document: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"@timestamp":     "2023-06-23T10:00:00Z",
+		"message":        "Test Elasticsearch",
+		"method":         http.MethodPost,
+		"scheme":         "http",
+		"host":           "test.com",
+		"path":           "/foo",
+		"query":          "bar=baz",
+		"protocol":       "HTTP/1.1",
+		"remote_addr":    "10.0.0.1:1234",
+		"user_agent":     "test-agent",
+		"content_length": float64(5),
+	}
+	for key, value := range expected {
+		if got[key] != value {
+			t.Errorf("%s: expected %v, got %v", key, value, got[key])
+		}
+	}
+}
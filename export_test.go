@@ -0,0 +1,36 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import "path/filepath"
+
+// SpoolInUse reports whether a pipeline still uses the spool of dir, so that tests can wait for the
+// shutdown of the instances using it.
+func SpoolInUse(dir string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	sharedSpools.mu.Lock()
+	defer sharedSpools.mu.Unlock()
+
+	return sharedSpools.spools[dir] != nil
+}
+
+// GeoIPDatabaseRefs returns the number of instances using the GeoIP database at path.
+func GeoIPDatabaseRefs(path string) int {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0
+	}
+
+	sharedGeoIPDatabases.mu.Lock()
+	defer sharedGeoIPDatabases.mu.Unlock()
+
+	if shared := sharedGeoIPDatabases.databases[path]; shared != nil {
+		return shared.refs
+	}
+	return 0
+}
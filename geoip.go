@@ -0,0 +1,308 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultGeoIPReloadInterval = "1m"
+
+// Geo is the geographical location of an IP address, named after the ECS geo fields.
+type Geo struct {
+	ContinentCode  string       `json:"continent_code,omitempty"`
+	ContinentName  string       `json:"continent_name,omitempty"`
+	CountryISOCode string       `json:"country_iso_code,omitempty"`
+	CountryName    string       `json:"country_name,omitempty"`
+	RegionISOCode  string       `json:"region_iso_code,omitempty"`
+	RegionName     string       `json:"region_name,omitempty"`
+	CityName       string       `json:"city_name,omitempty"`
+	Timezone       string       `json:"timezone,omitempty"`
+	Location       *GeoLocation `json:"location,omitempty"`
+}
+
+// GeoLocation is a point on Earth, in the format of an Elasticsearch geo_point.
+type GeoLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// AS is the autonomous system an IP address belongs to, named after the ECS as fields.
+type AS struct {
+	Number       uint64          `json:"number,omitempty"`
+	Organization *ASOrganization `json:"organization,omitempty"`
+}
+
+// ASOrganization is the organization operating an autonomous system.
+type ASOrganization struct {
+	Name string `json:"name"`
+}
+
+// geoIPDatabase is a MaxMind DB file loaded in memory.
+type geoIPDatabase struct {
+	path    string
+	reader  *mmdbReader
+	modTime time.Time
+	size    int64
+}
+
+// geoIPRegistry holds the GeoIP databases in use, keyed by their absolute path, so that the middleware
+// instances of every configuration share one copy of each database in memory.
+type geoIPRegistry struct {
+	mu        sync.Mutex
+	databases map[string]*sharedGeoIPDatabase
+}
+
+var sharedGeoIPDatabases = &geoIPRegistry{databases: make(map[string]*sharedGeoIPDatabase)}
+
+// sharedGeoIPDatabase is a database reloaded when its file changes on disk, until no instance uses it.
+type sharedGeoIPDatabase struct {
+	// refs is the number of instances using the database, guarded by the mutex of sharedGeoIPDatabases.
+	refs int
+	// stop is closed to stop watching the file once no instance uses the database.
+	stop chan struct{}
+
+	mu       sync.RWMutex
+	database *geoIPDatabase
+}
+
+// acquire returns the database at path, loading it if no instance uses it yet. A shared database is
+// checked for changes every reloadInterval of the instance that loaded it. The database must be
+// released with release.
+func (r *geoIPRegistry) acquire(path string, reloadInterval time.Duration) (*sharedGeoIPDatabase, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP database path: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shared := r.databases[path]
+	if shared == nil {
+		database, err := loadGeoIPDatabase(path)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedGeoIPDatabase{stop: make(chan struct{}), database: database}
+		r.databases[path] = shared
+		go shared.watch(reloadInterval)
+	}
+	shared.refs++
+	return shared, nil
+}
+
+// release releases a reference to shared, and stops watching its file if it was the last one.
+func (r *geoIPRegistry) release(shared *sharedGeoIPDatabase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	shared.refs--
+	if shared.refs > 0 {
+		return
+	}
+	delete(r.databases, shared.current().path)
+	close(shared.stop)
+}
+
+// geoIP enriches documents from local MaxMind DB files, such as GeoLite2 City and ASN.
+// The files are reloaded when they change on disk.
+type geoIP struct {
+	databases []*sharedGeoIPDatabase
+	once      sync.Once
+}
+
+// newGeoIP loads the databases at paths, or shares them with the other instances using them, and
+// releases them when ctx is done. It returns nil when no database is configured.
+func newGeoIP(ctx context.Context, paths []string, reloadInterval time.Duration) (*geoIP, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	g := &geoIP{}
+	for _, path := range paths {
+		database, err := sharedGeoIPDatabases.acquire(path, reloadInterval)
+		if err != nil {
+			g.close()
+			return nil, err
+		}
+		g.databases = append(g.databases, database)
+	}
+
+	// Without a done channel, the databases are kept for the lifetime of the process, with one watcher
+	// per file however many instances use it.
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			g.close()
+		}()
+	}
+
+	return g, nil
+}
+
+// close releases the databases of g.
+func (g *geoIP) close() {
+	g.once.Do(func() {
+		for _, database := range g.databases {
+			sharedGeoIPDatabases.release(database)
+		}
+	})
+}
+
+func loadGeoIPDatabase(path string) (*geoIPDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the GeoIP database: %w", err)
+	}
+
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the GeoIP database: %w", err)
+	}
+
+	reader, err := newMMDBReader(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the GeoIP database %s: %w", path, err)
+	}
+
+	return &geoIPDatabase{path: path, reader: reader, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// current returns the latest version of the database.
+func (s *sharedGeoIPDatabase) current() *geoIPDatabase {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.database
+}
+
+// watch reloads the database when the modification time or size of its file changes, until stop is closed.
+func (s *sharedGeoIPDatabase) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reload()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *sharedGeoIPDatabase) reload() {
+	database := s.current()
+	info, err := os.Stat(database.path)
+	if err != nil || (info.ModTime().Equal(database.modTime) && info.Size() == database.size) {
+		return
+	}
+
+	reloaded, err := loadGeoIPDatabase(database.path)
+	if err != nil {
+		log.Printf("Error reloading the GeoIP database, keeping the previous version: %s", err)
+		return
+	}
+	log.Printf("Reloaded the GeoIP database %s", database.path)
+
+	s.mu.Lock()
+	s.database = reloaded
+	s.mu.Unlock()
+}
+
+// lookup returns the location and autonomous system of ip found in the databases.
+func (g *geoIP) lookup(ip string) (*Geo, *AS) {
+	address := net.ParseIP(ip)
+	if g == nil || address == nil {
+		return nil, nil
+	}
+
+	var (
+		geo Geo
+		as  AS
+	)
+	for _, shared := range g.databases {
+		database := shared.current()
+		record, err := database.reader.lookup(address)
+		if err != nil {
+			log.Printf("Error looking up %s in the GeoIP database %s: %s", ip, database.path, err)
+			continue
+		}
+		if record != nil {
+			geo.fill(record)
+			as.fill(record)
+		}
+	}
+
+	var (
+		geoResult *Geo
+		asResult  *AS
+	)
+	if geo != (Geo{}) {
+		geoResult = &geo
+	}
+	if as.Number != 0 || as.Organization != nil {
+		asResult = &as
+	}
+	return geoResult, asResult
+}
+
+// fill copies the fields of a GeoIP2 or GeoLite2 City or Country record.
+func (g *Geo) fill(record map[string]interface{}) {
+	if continent := mmdbMap(record["continent"]); continent != nil {
+		g.ContinentCode = mmdbString(continent["code"])
+		g.ContinentName = mmdbName(continent)
+	}
+	if country := mmdbMap(record["country"]); country != nil {
+		g.CountryISOCode = mmdbString(country["iso_code"])
+		g.CountryName = mmdbName(country)
+	}
+	if subdivisions, ok := record["subdivisions"].([]interface{}); ok && len(subdivisions) > 0 {
+		if region := mmdbMap(subdivisions[0]); region != nil {
+			if code := mmdbString(region["iso_code"]); code != "" && g.CountryISOCode != "" {
+				g.RegionISOCode = g.CountryISOCode + "-" + code
+			}
+			g.RegionName = mmdbName(region)
+		}
+	}
+	if city := mmdbMap(record["city"]); city != nil {
+		g.CityName = mmdbName(city)
+	}
+	if location := mmdbMap(record["location"]); location != nil {
+		g.Timezone = mmdbString(location["time_zone"])
+		lat, latOK := location["latitude"].(float64)
+		lon, lonOK := location["longitude"].(float64)
+		if latOK && lonOK {
+			g.Location = &GeoLocation{Lat: lat, Lon: lon}
+		}
+	}
+}
+
+// fill copies the fields of a GeoLite2 ASN record.
+func (a *AS) fill(record map[string]interface{}) {
+	if number := mmdbUint(record["autonomous_system_number"]); number != 0 {
+		a.Number = uint64(number)
+	}
+	if name := mmdbString(record["autonomous_system_organization"]); name != "" {
+		a.Organization = &ASOrganization{Name: name}
+	}
+}
+
+func mmdbMap(value interface{}) map[string]interface{} {
+	m, _ := value.(map[string]interface{})
+	return m
+}
+
+// mmdbName returns the English name of a GeoIP2 record.
+func mmdbName(record map[string]interface{}) string {
+	return mmdbString(mmdbMap(record["names"])["en"])
+}
@@ -0,0 +1,295 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestGeoIPEnrichment(t *testing.T) {
+	dir := t.TempDir()
+	cityDB := filepath.Join(dir, "city.mmdb")
+	asnDB := filepath.Join(dir, "asn.mmdb")
+
+	writeMMDB(t, cityDB, 6, "GeoLite2-City", map[string]map[string]interface{}{
+		"81.2.69.0/24": cityRecord("London"),
+	})
+	writeMMDB(t, asnDB, 4, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"81.2.64.0/20": {
+			"autonomous_system_number":       uint64(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		},
+	})
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.GeoIPDatabases = []string{cityDB, asnDB}
+	cfg.GeoIPReloadInterval = "10ms"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	serve := func(remoteAddr string) map[string]interface{} {
+		t.Helper()
+
+		n := len(es.Documents()) + 1
+		req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+		req.RemoteAddr = remoteAddr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		docs := es.WaitForDocuments(t, n)
+		if len(docs) != n {
+			t.Fatalf("expected %d indexed documents, got %d", n, len(docs))
+		}
+		return docs[n-1]
+	}
+
+	doc := serve("81.2.69.160:1234")
+	expectedGeo := map[string]interface{}{
+		"continent_code":   "EU",
+		"continent_name":   "Europe",
+		"country_iso_code": "GB",
+		"country_name":     "United Kingdom",
+		"region_iso_code":  "GB-ENG",
+		"region_name":      "England",
+		"city_name":        "London",
+		"timezone":         "Europe/London",
+		"location":         map[string]interface{}{"lat": 51.5142, "lon": -0.0931},
+	}
+	if !reflect.DeepEqual(doc["geo"], expectedGeo) {
+		t.Errorf("expected geo %v, got %v", expectedGeo, doc["geo"])
+	}
+	expectedAS := map[string]interface{}{
+		"number":       float64(20712),
+		"organization": map[string]interface{}{"name": "Andrews & Arnold Ltd"},
+	}
+	if !reflect.DeepEqual(doc["as"], expectedAS) {
+		t.Errorf("expected as %v, got %v", expectedAS, doc["as"])
+	}
+
+	doc = serve("192.0.2.1:1234")
+	if doc["geo"] != nil || doc["as"] != nil {
+		t.Errorf("expected no geo or as for an unknown address, got %v and %v", doc["geo"], doc["as"])
+	}
+
+	writeMMDB(t, cityDB, 6, "GeoLite2-City", map[string]map[string]interface{}{
+		"81.2.69.0/24": cityRecord("Manchester"),
+	})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(cityDB, later, later); err != nil {
+		t.Fatalf("Could not touch the database: %v", err)
+	}
+
+	waitFor(t, func() bool {
+		return lookup(serve("81.2.69.160:1234"), "geo.city_name") == "Manchester"
+	})
+}
+
+func TestGeoIPDatabasesAreShared(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "city.mmdb")
+	writeMMDB(t, database, 6, "GeoLite2-City", map[string]map[string]interface{}{
+		"81.2.69.0/24": cityRecord("London"),
+	})
+
+	es := newFakeElasticsearch(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var cancels []context.CancelFunc
+	for _, index := range []string{"first", "second"} {
+		cfg := loadConfig()
+		cfg.ElasticsearchURL = es.URL
+		cfg.IndexName = index
+		cfg.GeoIPDatabases = []string{database}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		cancels = append(cancels, cancel)
+
+		if _, err := traefik_plugin_elastic.New(ctx, next, cfg, "test"); err != nil {
+			t.Fatalf("Could not create the middleware: %v", err)
+		}
+	}
+	if refs := traefik_plugin_elastic.GeoIPDatabaseRefs(database); refs != 2 {
+		t.Fatalf("expected the database to be shared by 2 instances, got %d", refs)
+	}
+
+	cancels[0]()
+	waitFor(t, func() bool { return traefik_plugin_elastic.GeoIPDatabaseRefs(database) == 1 })
+	cancels[1]()
+	waitFor(t, func() bool { return traefik_plugin_elastic.GeoIPDatabaseRefs(database) == 0 })
+}
+
+func cityRecord(city string) map[string]interface{} {
+	return map[string]interface{}{
+		"city":      map[string]interface{}{"names": map[string]interface{}{"en": city}},
+		"continent": map[string]interface{}{"code": "EU", "names": map[string]interface{}{"en": "Europe"}},
+		"country":   map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}},
+		"location": map[string]interface{}{
+			"latitude":  51.5142,
+			"longitude": -0.0931,
+			"time_zone": "Europe/London",
+		},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}},
+		},
+	}
+}
+
+// writeMMDB writes a MaxMind DB file with 24-bit records holding records for the given networks.
+func writeMMDB(t *testing.T, path string, ipVersion int, databaseType string, networks map[string]map[string]interface{}) {
+	t.Helper()
+
+	type node struct{ records [2]int }
+	const (
+		empty = -1
+		data  = -2
+	)
+
+	var (
+		nodes   = []*node{{records: [2]int{empty, empty}}}
+		leaves  = map[[2]int]int{}
+		section bytes.Buffer
+	)
+
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid network %s: %v", cidr, err)
+		}
+		ones, _ := network.Mask.Size()
+		address := []byte(network.IP.To4())
+		if ipVersion == 6 {
+			address = append(make([]byte, 12), address...)
+			ones += 96
+		}
+
+		offset := section.Len()
+		encodeMMDBValue(t, &section, networks[cidr])
+
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(address[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[current].records[bit] = data
+				leaves[[2]int{current, bit}] = offset
+				break
+			}
+			if nodes[current].records[bit] == empty {
+				nodes = append(nodes, &node{records: [2]int{empty, empty}})
+				nodes[current].records[bit] = len(nodes) - 1
+			}
+			current = nodes[current].records[bit]
+		}
+	}
+
+	var file bytes.Buffer
+	for i, n := range nodes {
+		for bit, record := range n.records {
+			value := record
+			switch record {
+			case empty:
+				value = len(nodes)
+			case data:
+				value = len(nodes) + 16 + leaves[[2]int{i, bit}]
+			}
+			file.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	file.Write(make([]byte, 16))
+	file.Write(section.Bytes())
+	file.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeMMDBValue(t, &file, map[string]interface{}{
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               databaseType,
+		"ip_version":                  uint64(ipVersion),
+		"node_count":                  uint64(len(nodes)),
+		"record_size":                 uint64(24),
+	})
+
+	if err := os.WriteFile(path, file.Bytes(), 0o600); err != nil {
+		t.Fatalf("Could not write the database: %v", err)
+	}
+}
+
+func encodeMMDBValue(t *testing.T, buf *bytes.Buffer, value interface{}) {
+	t.Helper()
+
+	control := func(kind, size int) {
+		if size >= 285 {
+			t.Fatalf("value too large for the test encoder: %d", size)
+		}
+
+		sizeBits, extra := size, []byte(nil)
+		if size >= 29 {
+			sizeBits, extra = 29, []byte{byte(size - 29)}
+		}
+
+		if kind <= 7 {
+			buf.WriteByte(byte(kind<<5 | sizeBits))
+		} else {
+			buf.WriteByte(byte(sizeBits))
+			buf.WriteByte(byte(kind - 7))
+		}
+		buf.Write(extra)
+	}
+
+	switch v := value.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case float64:
+		control(3, 8)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case uint64:
+		control(9, 8)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, item := range v {
+			encodeMMDBValue(t, buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		control(7, len(keys))
+		for _, key := range keys {
+			encodeMMDBValue(t, buf, key)
+			encodeMMDBValue(t, buf, v[key])
+		}
+	default:
+		t.Fatalf("unsupported value %T", value)
+	}
+}
@@ -0,0 +1,498 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// GraphQLVariablesDrop leaves the operation variables out of the documents.
+	GraphQLVariablesDrop = "drop"
+	// GraphQLVariablesRedact logs the operation variables with the values of the redacted keys masked.
+	GraphQLVariablesRedact = "redact"
+
+	defaultGraphQLPath      = "/graphql"
+	defaultGraphQLVariables = GraphQLVariablesDrop
+	defaultGraphQLMaxBytes  = 1 << 20
+)
+
+// GraphQLOperation describes a GraphQL operation sent in a request.
+type GraphQLOperation struct {
+	// Name is the operation name, from the operationName parameter or the operation definition.
+	Name string `json:"operation_name,omitempty"`
+	// Type is query, mutation or subscription.
+	Type string `json:"operation_type,omitempty"`
+	// Fields lists the top-level fields selected by the operation.
+	Fields []string `json:"fields,omitempty"`
+	// QueryHash is the hex-encoded SHA-256 hash of the query with its comments and insignificant
+	// whitespace and commas removed, stable across formatting changes.
+	QueryHash string `json:"query_hash,omitempty"`
+	// PersistedQueryHash is the hash of the persisted query the request refers to.
+	PersistedQueryHash string `json:"persisted_query_hash,omitempty"`
+	// Variables are the operation variables, when they are not dropped.
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// graphQLRequest is a GraphQL request as sent in a JSON body or in query parameters.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    struct {
+		PersistedQuery struct {
+			SHA256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+// graphQLParser detects GraphQL requests and describes their operations.
+type graphQLParser struct {
+	paths     map[string]bool
+	variables string
+	redact    map[string]bool
+	maxBytes  int
+}
+
+func newGraphQLParser(paths []string, variables string, redact []string, maxBytes int) (*graphQLParser, error) {
+	if len(paths) == 0 {
+		paths = []string{defaultGraphQLPath}
+	}
+	if variables == "" {
+		variables = defaultGraphQLVariables
+	}
+	if variables != GraphQLVariablesDrop && variables != GraphQLVariablesRedact {
+		return nil, fmt.Errorf("unknown GraphQL variables policy %q", variables)
+	}
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid GraphQL body size: %d", maxBytes)
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultGraphQLMaxBytes
+	}
+
+	p := &graphQLParser{
+		paths:     make(map[string]bool, len(paths)),
+		variables: variables,
+		redact:    make(map[string]bool, len(redact)),
+		maxBytes:  maxBytes,
+	}
+	for _, path := range paths {
+		p.paths[path] = true
+	}
+	for _, key := range redact {
+		p.redact[strings.ToLower(key)] = true
+	}
+	return p, nil
+}
+
+// parse describes the GraphQL operations of req, or returns nil when req is not a GraphQL request.
+// The body of a POST request is read up to maxBytes and restored for the next handler.
+func (p *graphQLParser) parse(req *http.Request) []GraphQLOperation {
+	if p == nil || !p.paths[req.URL.Path] {
+		return nil
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		q := req.URL.Query()
+		r := graphQLRequest{Query: q.Get("query"), OperationName: q.Get("operationName")}
+		if variables := q.Get("variables"); variables != "" {
+			_ = json.Unmarshal([]byte(variables), &r.Variables)
+		}
+		if extensions := q.Get("extensions"); extensions != "" {
+			_ = json.Unmarshal([]byte(extensions), &r.Extensions)
+		}
+		return p.operations([]graphQLRequest{r})
+	case http.MethodPost:
+		// Only GraphQL media types are buffered, so that uploads to the endpoint stream through.
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/json" && mediaType != "application/graphql" {
+			return nil
+		}
+		body := p.readBody(req)
+		if len(body) == 0 {
+			return nil
+		}
+		if mediaType == "application/graphql" {
+			return p.operations([]graphQLRequest{{Query: string(body), OperationName: req.URL.Query().Get("operationName")}})
+		}
+		return p.operations(decodeGraphQLRequests(body))
+	default:
+		return nil
+	}
+}
+
+// redactQuery returns rawQuery, the query string of req, with the variables parameter of a GraphQL GET
+// request dropped or redacted like the operation variables, so that they do not leak through the
+// query and URL of the document.
+func (p *graphQLParser) redactQuery(req *http.Request, rawQuery string) string {
+	if p == nil || req.Method != http.MethodGet || !p.paths[req.URL.Path] || rawQuery == "" {
+		return rawQuery
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err != nil || name != "variables" {
+			kept = append(kept, pair)
+			continue
+		}
+		if p.variables == GraphQLVariablesRedact {
+			kept = append(kept, key+"="+url.QueryEscape(p.redactRawVariables(value)))
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// redactRawVariables redacts the escaped JSON variables of a query string. Variables that cannot be
+// decoded are masked as a whole.
+func (p *graphQLParser) redactRawVariables(value string) string {
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return redactedValue
+	}
+	var variables interface{}
+	if err := json.Unmarshal([]byte(unescaped), &variables); err != nil {
+		return redactedValue
+	}
+	redacted, err := json.Marshal(p.redactValue(variables))
+	if err != nil {
+		return redactedValue
+	}
+	return string(redacted)
+}
+
+// readBody reads up to maxBytes of the request body and puts them back in front of the rest of it.
+// It returns nil when the body is larger than maxBytes.
+func (p *graphQLParser) readBody(req *http.Request) []byte {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, int64(p.maxBytes)+1))
+	req.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(buf), req.Body), Closer: req.Body}
+	if err != nil || len(buf) > p.maxBytes {
+		return nil
+	}
+	return buf
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decodeGraphQLRequests decodes a single GraphQL request or a batch of them.
+func decodeGraphQLRequests(body []byte) []graphQLRequest {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []graphQLRequest
+		if json.Unmarshal(body, &batch) != nil {
+			return nil
+		}
+		return batch
+	}
+
+	var r graphQLRequest
+	if json.Unmarshal(body, &r) != nil {
+		return nil
+	}
+	return []graphQLRequest{r}
+}
+
+func (p *graphQLParser) operations(requests []graphQLRequest) []GraphQLOperation {
+	var operations []GraphQLOperation
+	for _, r := range requests {
+		op := GraphQLOperation{
+			Name:               r.OperationName,
+			PersistedQueryHash: r.Extensions.PersistedQuery.SHA256Hash,
+		}
+		if r.Query != "" {
+			tokens := lexGraphQL(r.Query)
+			sum := sha256.Sum256([]byte(strings.Join(tokens, " ")))
+			op.QueryHash = hex.EncodeToString(sum[:])
+			if def := selectGraphQLOperation(tokens, r.OperationName); def != nil {
+				op.Type = def.kind
+				op.Fields = def.fields
+				if op.Name == "" {
+					op.Name = def.name
+				}
+			}
+		}
+		if op.QueryHash == "" && op.PersistedQueryHash == "" {
+			continue
+		}
+		if p.variables == GraphQLVariablesRedact && len(r.Variables) > 0 {
+			op.Variables, _ = p.redactValue(r.Variables).(map[string]interface{})
+		}
+		operations = append(operations, op)
+	}
+	return operations
+}
+
+// redactValue returns value with the values of the redacted keys, at any depth, replaced by a mask.
+func (p *graphQLParser) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if p.redact[strings.ToLower(key)] {
+				out[key] = redactedValue
+			} else {
+				out[key] = p.redactValue(item)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = p.redactValue(item)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// graphQLDefinition is an operation defined in a GraphQL document.
+type graphQLDefinition struct {
+	kind   string
+	name   string
+	fields []string
+}
+
+// selectGraphQLOperation returns the operation of the document named name, or its only operation when
+// name is empty. Its fields are the top-level fields of its selection set, with the fields of the
+// fragments it spreads at the top level.
+func selectGraphQLOperation(tokens []string, name string) *graphQLDefinition {
+	var operations []*graphQLDefinition
+	fragments := make(map[string][]string)
+
+	for i := 0; i < len(tokens); {
+		switch tokens[i] {
+		case "fragment":
+			// fragment Name on Type directives? { selection }
+			if i+1 >= len(tokens) {
+				return nil
+			}
+			fragment := tokens[i+1]
+			start := skipDirectives(tokens, i+4)
+			if start >= len(tokens) || tokens[start] != "{" {
+				return nil
+			}
+			fragments[fragment], i = selectionFields(tokens, start)
+		case "query", "mutation", "subscription", "{":
+			// (query|mutation|subscription) Name? Variables? directives? { selection }
+			def := &graphQLDefinition{kind: "query"}
+			start := i
+			if tokens[i] != "{" {
+				def.kind = tokens[i]
+				start++
+				if start < len(tokens) && isGraphQLName(tokens[start]) {
+					def.name = tokens[start]
+					start++
+				}
+				if start < len(tokens) && tokens[start] == "(" {
+					start = skipGroup(tokens, start, "(", ")")
+				}
+				start = skipDirectives(tokens, start)
+			}
+			if start >= len(tokens) || tokens[start] != "{" {
+				return nil
+			}
+			def.fields, i = selectionFields(tokens, start)
+			operations = append(operations, def)
+		default:
+			i++
+		}
+	}
+
+	var selected *graphQLDefinition
+	for _, op := range operations {
+		if (name == "" && len(operations) == 1) || (name != "" && op.name == name) {
+			selected = op
+			break
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	var fields []string
+	seen := make(map[string]bool)
+	var expand func(names []string, depth int)
+	expand = func(names []string, depth int) {
+		for _, f := range names {
+			if strings.HasPrefix(f, "...") {
+				// Fragments may not form cycles, but the query is not validated.
+				if depth < 8 {
+					expand(fragments[f[3:]], depth+1)
+				}
+				continue
+			}
+			if !seen[f] {
+				seen[f] = true
+				fields = append(fields, f)
+			}
+		}
+	}
+	expand(selected.fields, 0)
+	selected.fields = fields
+	return selected
+}
+
+// selectionFields returns the names of the fields of the selection set starting at the { token at start,
+// and the index following its closing }. The fields of inline fragments are included, and named fragment
+// spreads are returned as "...Name".
+func selectionFields(tokens []string, start int) ([]string, int) {
+	var fields []string
+	i := start + 1
+	for i < len(tokens) && tokens[i] != "}" {
+		switch token := tokens[i]; {
+		case token == "...":
+			if i+1 < len(tokens) && isGraphQLName(tokens[i+1]) && tokens[i+1] != "on" {
+				fields = append(fields, "..."+tokens[i+1])
+				i = skipDirectives(tokens, i+2)
+				continue
+			}
+			// ... on Type? directives? { selection }
+			i++
+			if i < len(tokens) && tokens[i] == "on" {
+				i += 2
+			}
+			i = skipDirectives(tokens, i)
+			if i < len(tokens) && tokens[i] == "{" {
+				var inline []string
+				inline, i = selectionFields(tokens, i)
+				fields = append(fields, inline...)
+			}
+		case isGraphQLName(token):
+			// alias? : name arguments? directives? selection?
+			if i+2 < len(tokens) && tokens[i+1] == ":" {
+				i += 2
+			}
+			fields = append(fields, tokens[i])
+			i++
+			if i < len(tokens) && tokens[i] == "(" {
+				i = skipGroup(tokens, i, "(", ")")
+			}
+			i = skipDirectives(tokens, i)
+			if i < len(tokens) && tokens[i] == "{" {
+				i = skipGroup(tokens, i, "{", "}")
+			}
+		default:
+			i++
+		}
+	}
+	return fields, i + 1
+}
+
+// skipDirectives returns the index of the first token from i that is not part of a directive.
+func skipDirectives(tokens []string, i int) int {
+	for i+1 < len(tokens) && tokens[i] == "@" {
+		i += 2
+		if i < len(tokens) && tokens[i] == "(" {
+			i = skipGroup(tokens, i, "(", ")")
+		}
+	}
+	return i
+}
+
+// skipGroup returns the index following the close token matching the open token at start.
+func skipGroup(tokens []string, start int, open, close string) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(tokens)
+}
+
+func isGraphQLName(token string) bool {
+	if token == "" {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		if !isGraphQLNameByte(token[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGraphQLNameByte reports whether c can appear in a name, at its start when first is set.
+func isGraphQLNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// lexGraphQL splits a GraphQL document into its tokens, leaving out whitespace, commas and comments.
+// It is lenient: unexpected characters are returned as single-character tokens.
+func lexGraphQL(query string) []string {
+	var tokens []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		end := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+			continue
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(query[i:], "..."):
+			end = i + 3
+		case strings.HasPrefix(query[i:], `"""`):
+			end = i + 3
+			for end < len(query) && !strings.HasPrefix(query[end:], `"""`) {
+				if strings.HasPrefix(query[end:], `\"""`) {
+					end += 3
+				}
+				end++
+			}
+			end += 3
+		case c == '"':
+			for end < len(query) && query[end] != '"' && query[end] != '\n' {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		case isGraphQLNameByte(c, true):
+			for end < len(query) && isGraphQLNameByte(query[end], false) {
+				end++
+			}
+		case c == '-' || (c >= '0' && c <= '9'):
+			for end < len(query) && strings.IndexByte("0123456789.eE+-", query[end]) >= 0 {
+				end++
+			}
+		}
+		if end > len(query) {
+			end = len(query)
+		}
+		tokens = append(tokens, query[i:end])
+		i = end
+	}
+	return tokens
+}
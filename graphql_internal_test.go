@@ -0,0 +1,173 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLexGraphQL(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		query    string
+		expected []string
+	}{
+		{
+			desc:     "names and punctuation",
+			query:    "query Me($id: ID!) { me(id: $id) { id, name } }",
+			expected: []string{"query", "Me", "(", "$", "id", ":", "ID", "!", ")", "{", "me", "(", "id", ":", "$", "id", ")", "{", "id", "name", "}", "}"},
+		},
+		{
+			desc:     "names with digits and underscores",
+			query:    "_a1 b_2c",
+			expected: []string{"_a1", "b_2c"},
+		},
+		{
+			desc:     "comments",
+			query:    "# who am I\n{ me }",
+			expected: []string{"{", "me", "}"},
+		},
+		{
+			desc:     "spread",
+			query:    "...Fragment ... on User",
+			expected: []string{"...", "Fragment", "...", "on", "User"},
+		},
+		{
+			desc:     "strings",
+			query:    `f(a: "x \" y", b: """block "" \""" string""")`,
+			expected: []string{"f", "(", "a", ":", `"x \" y"`, "b", ":", `"""block "" \""" string"""`, ")"},
+		},
+		{
+			desc:     "numbers",
+			query:    "f(a: -1.5e+3, b: 42)",
+			expected: []string{"f", "(", "a", ":", "-1.5e+3", "b", ":", "42", ")"},
+		},
+		{
+			desc:     "unterminated string",
+			query:    `f(a: "x`,
+			expected: []string{"f", "(", "a", ":", `"x`},
+		},
+		{
+			desc:     "unexpected characters",
+			query:    "a ? b",
+			expected: []string{"a", "?", "b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := lexGraphQL(test.query); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestLexGraphQLLongNames(t *testing.T) {
+	query := "{ " + strings.Repeat("a", defaultGraphQLMaxBytes) + " }"
+
+	start := time.Now()
+	tokens := lexGraphQL(query)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a 1 MiB name to be lexed in linear time, took %s", elapsed)
+	}
+	if len(tokens) != 3 || len(tokens[1]) != defaultGraphQLMaxBytes {
+		t.Errorf("expected the name to be a single token, got %d tokens", len(tokens))
+	}
+}
+
+func TestGraphQLParserSkipsOtherMediaTypes(t *testing.T) {
+	p, err := newGraphQLParser(nil, "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, contentType := range []string{"", "multipart/form-data; boundary=x", "application/octet-stream"} {
+		req := httptest.NewRequest(http.MethodPost, "http://test.com/graphql", nil)
+		req.Body = unreadableBody{}
+		req.Header.Set("Content-Type", contentType)
+
+		if operations := p.parse(req); operations != nil {
+			t.Errorf("expected no operation for %q, got %v", contentType, operations)
+		}
+		if _, ok := req.Body.(unreadableBody); !ok {
+			t.Errorf("expected the %q body to be left untouched", contentType)
+		}
+	}
+}
+
+func TestGraphQLParserRedactsQueryVariables(t *testing.T) {
+	variables := url.QueryEscape(`{"id":"1","password":"secret"}`)
+	testCases := []struct {
+		desc      string
+		variables string
+		method    string
+		target    string
+		expected  string
+	}{
+		{
+			desc:      "dropped",
+			variables: GraphQLVariablesDrop,
+			method:    http.MethodGet,
+			target:    "http://test.com/graphql?query=%7Bme%7D&variables=" + variables + "&operationName=Me",
+			expected:  "query=%7Bme%7D&operationName=Me",
+		},
+		{
+			desc:      "redacted",
+			variables: GraphQLVariablesRedact,
+			method:    http.MethodGet,
+			target:    "http://test.com/graphql?query=%7Bme%7D&variables=" + variables,
+			expected:  "query=%7Bme%7D&variables=" + url.QueryEscape(`{"id":"1","password":"[REDACTED]"}`),
+		},
+		{
+			desc:      "undecodable",
+			variables: GraphQLVariablesRedact,
+			method:    http.MethodGet,
+			target:    "http://test.com/graphql?variables=%7Bpassword",
+			expected:  "variables=" + url.QueryEscape(redactedValue),
+		},
+		{
+			desc:      "other path",
+			variables: GraphQLVariablesDrop,
+			method:    http.MethodGet,
+			target:    "http://test.com/search?variables=" + variables,
+			expected:  "variables=" + variables,
+		},
+		{
+			desc:      "POST request",
+			variables: GraphQLVariablesDrop,
+			method:    http.MethodPost,
+			target:    "http://test.com/graphql?variables=" + variables,
+			expected:  "variables=" + variables,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			p, err := newGraphQLParser(nil, test.variables, []string{"password"}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(test.method, test.target, nil)
+			if query := p.redactQuery(req, req.URL.RawQuery); query != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, query)
+			}
+		})
+	}
+}
+
+// unreadableBody is a request body that cannot be read.
+type unreadableBody struct{}
+
+func (unreadableBody) Read([]byte) (int, error) { return 0, errors.New("body read") }
+
+func (unreadableBody) Close() error { return nil }
@@ -0,0 +1,236 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestGraphQLOperations(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		expected    []interface{}
+	}{
+		{
+			desc:        "named query",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/json",
+			body:        `{"query":"query GetUser($id: ID!) { me: user(id: $id) { name } ... on Query { spaces { id } } ...Extra }\nfragment Extra on Query { platform { id } }","variables":{"id":"1","input":{"password":"secret"}}}`,
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_name": "GetUser",
+					"operation_type": "query",
+					"fields":         []interface{}{"user", "spaces", "platform"},
+					"query_hash":     "*",
+					"variables":      map[string]interface{}{"id": "1", "input": map[string]interface{}{"password": "[REDACTED]"}},
+				},
+			},
+		},
+		{
+			desc:        "operation selected by name",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/json",
+			body:        `{"operationName":"Update","query":"query Read { a } mutation Update($v: In = {x: 1}) @auth { update(v: $v) { id } other }"}`,
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_name": "Update",
+					"operation_type": "mutation",
+					"fields":         []interface{}{"update", "other"},
+					"query_hash":     "*",
+				},
+			},
+		},
+		{
+			desc:        "batched operations",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/json",
+			body:        `[{"query":"{ me { id } }"},{"query":"subscription OnMessage { messageReceived { id } }"}]`,
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_type": "query",
+					"fields":         []interface{}{"me"},
+					"query_hash":     "*",
+				},
+				map[string]interface{}{
+					"operation_name": "OnMessage",
+					"operation_type": "subscription",
+					"fields":         []interface{}{"messageReceived"},
+					"query_hash":     "*",
+				},
+			},
+		},
+		{
+			desc:        "persisted query",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/json",
+			body:        `{"operationName":"GetUser","extensions":{"persistedQuery":{"version":1,"sha256Hash":"abc123"}}}`,
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_name":       "GetUser",
+					"persisted_query_hash": "abc123",
+				},
+			},
+		},
+		{
+			desc:   "query parameters",
+			method: http.MethodGet,
+			target: "http://test.com/graphql?query=" + url.QueryEscape("query Me { me { id } }"),
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_name": "Me",
+					"operation_type": "query",
+					"fields":         []interface{}{"me"},
+					"query_hash":     "*",
+				},
+			},
+		},
+		{
+			desc:        "application/graphql body",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/graphql",
+			body:        "mutation { logout }",
+			expected: []interface{}{
+				map[string]interface{}{
+					"operation_type": "mutation",
+					"fields":         []interface{}{"logout"},
+					"query_hash":     "*",
+				},
+			},
+		},
+		{
+			desc:        "other path",
+			method:      http.MethodPost,
+			target:      "http://test.com/api",
+			contentType: "application/json",
+			body:        `{"query":"{ me { id } }"}`,
+		},
+		{
+			desc:        "other content type",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "multipart/form-data; boundary=x",
+			body:        `{"query":"{ me { id } }"}`,
+		},
+		{
+			desc:        "not GraphQL",
+			method:      http.MethodPost,
+			target:      "http://test.com/graphql",
+			contentType: "application/json",
+			body:        `{"hello":"world"}`,
+		},
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.ParseGraphQL = true
+	cfg.GraphQLVariables = traefik_plugin_elastic.GraphQLVariablesRedact
+	cfg.GraphQLRedactVariables = []string{"Password"}
+
+	var received string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for i, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if received != test.body {
+				t.Errorf("expected the next handler to receive %q, got %q", test.body, received)
+			}
+
+			docs := es.WaitForDocuments(t, i+1)
+			if len(docs) != i+1 {
+				t.Fatalf("expected %d indexed documents, got %d", i+1, len(docs))
+			}
+
+			got, _ := docs[i]["graphql"].([]interface{})
+			for _, op := range got {
+				op := op.(map[string]interface{})
+				if hash, ok := op["query_hash"].(string); ok && len(hash) == 64 {
+					op["query_hash"] = "*"
+				}
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestGraphQLQueryHashIgnoresFormatting(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.ParseGraphQL = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for _, body := range []string{
+		`{"query":"query Me { me { id, name } }","variables":{"id":"1"}}`,
+		`{"query":"# who am I\n query Me {\n  me {\n    id\n    name\n  }\n}\n"}`,
+		`{"query":"query Me { me { id } }"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://test.com/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	docs := es.WaitForDocuments(t, 3)
+	if len(docs) != 3 {
+		t.Fatalf("expected 3 indexed documents, got %d", len(docs))
+	}
+
+	hashes := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		operations, _ := doc["graphql"].([]interface{})
+		if len(operations) != 1 {
+			t.Fatalf("expected 1 GraphQL operation, got %v", doc["graphql"])
+		}
+		op := operations[0].(map[string]interface{})
+		hashes = append(hashes, op["query_hash"])
+		if variables := op["variables"]; variables != nil {
+			t.Errorf("expected the variables to be dropped, got %v", variables)
+		}
+	}
+	if hashes[0] == nil || hashes[0] != hashes[1] {
+		t.Errorf("expected formatting to keep the query hash, got %v and %v", hashes[0], hashes[1])
+	}
+	if hashes[0] == hashes[2] {
+		t.Errorf("expected a different query to change the hash, got %v", hashes[2])
+	}
+}
@@ -0,0 +1,115 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// RedactionMask replaces the value of redacted headers with a fixed mask.
+	RedactionMask = "mask"
+	// RedactionHash replaces the value of redacted headers with their SHA-256 hash, so that
+	// equal values can still be correlated.
+	RedactionHash = "hash"
+
+	defaultHeaderRedaction = RedactionMask
+
+	redactedValue = "[REDACTED]"
+)
+
+// sensitiveHeaders are always redacted, whatever the configuration.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// headerFilter selects the headers copied into documents and redacts sensitive values.
+type headerFilter struct {
+	// include holds the headers to capture; all headers are captured when it is empty.
+	include map[string]bool
+	exclude map[string]bool
+	redact  map[string]bool
+	hash    bool
+}
+
+// newHeaderFilter creates the header filter of config, or returns nil when header capture is disabled.
+func newHeaderFilter(config *Config) (*headerFilter, error) {
+	if !config.CaptureHeaders {
+		return nil, nil
+	}
+
+	f := &headerFilter{
+		include: canonicalHeaderSet(config.IncludeHeaders),
+		exclude: canonicalHeaderSet(config.ExcludeHeaders),
+		redact:  canonicalHeaderSet(sensitiveHeaders),
+	}
+	for name := range canonicalHeaderSet(config.RedactHeaders) {
+		f.redact[name] = true
+	}
+
+	switch config.HeaderRedaction {
+	case "", RedactionMask:
+	case RedactionHash:
+		f.hash = true
+	default:
+		return nil, fmt.Errorf("unknown header redaction %q: expected %s or %s", config.HeaderRedaction, RedactionMask, RedactionHash)
+	}
+
+	return f, nil
+}
+
+// capture returns the headers of h selected by the filter, keyed by their lowercase name.
+// Multiple values of a header are joined with a comma.
+func (f *headerFilter) capture(h http.Header) map[string]string {
+	if f == nil || len(h) == 0 {
+		return nil
+	}
+
+	captured := make(map[string]string)
+	for name, values := range h {
+		name = http.CanonicalHeaderKey(name)
+		if (len(f.include) > 0 && !f.include[name]) || f.exclude[name] {
+			continue
+		}
+
+		value := strings.Join(values, ", ")
+		if f.redact[name] {
+			value = f.redactValue(value)
+		}
+
+		// Dots would be interpreted by Elasticsearch as object paths.
+		captured[strings.ReplaceAll(strings.ToLower(name), ".", "_")] = value
+	}
+
+	if len(captured) == 0 {
+		return nil
+	}
+	return captured
+}
+
+func (f *headerFilter) redactValue(value string) string {
+	if !f.hash {
+		return redactedValue
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func canonicalHeaderSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,107 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestHeaderCapture(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		update           func(cfg *traefik_plugin_elastic.Config)
+		expectedRequest  map[string]interface{}
+		expectedResponse map[string]interface{}
+	}{
+		{
+			desc: "disabled",
+		},
+		{
+			desc: "sensitive headers are masked by default",
+			update: func(cfg *traefik_plugin_elastic.Config) {
+				cfg.CaptureHeaders = true
+			},
+			expectedRequest: map[string]interface{}{
+				"authorization": "[REDACTED]",
+				"cookie":        "[REDACTED]",
+				"x-session":     "abc",
+				"x-tenant":      "alkemio",
+			},
+			expectedResponse: map[string]interface{}{
+				"content-type": "text/plain",
+				"set-cookie":   "[REDACTED]",
+			},
+		},
+		{
+			desc: "allowlist, denylist and hashing",
+			update: func(cfg *traefik_plugin_elastic.Config) {
+				cfg.CaptureHeaders = true
+				cfg.IncludeHeaders = []string{"authorization", "x-session", "x-tenant", "content-type"}
+				cfg.ExcludeHeaders = []string{"X-Tenant"}
+				cfg.RedactHeaders = []string{"X-Session"}
+				cfg.HeaderRedaction = traefik_plugin_elastic.RedactionHash
+			},
+			expectedRequest: map[string]interface{}{
+				"authorization": "sha256:b22ac30e61f624d5d9ecfaec62edc932976e15d2f1599809297f5422ed3b396b",
+				"x-session":     "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+			},
+			expectedResponse: map[string]interface{}{
+				"content-type": "text/plain",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			if test.update != nil {
+				test.update(cfg)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Set-Cookie", "session=secret")
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			req.Header.Set("Cookie", "session=secret")
+			req.Header.Set("X-Session", "abc")
+			req.Header.Set("X-Tenant", "alkemio")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			if got := lookup(docs[0], "request_headers"); !equalHeaders(got, test.expectedRequest) {
+				t.Errorf("request headers: expected %v, got %v", test.expectedRequest, got)
+			}
+			if got := lookup(docs[0], "response_headers"); !equalHeaders(got, test.expectedResponse) {
+				t.Errorf("response headers: expected %v, got %v", test.expectedResponse, got)
+			}
+		})
+	}
+}
+
+func equalHeaders(got interface{}, expected map[string]interface{}) bool {
+	if expected == nil {
+		return got == nil
+	}
+	return reflect.DeepEqual(got, expected)
+}
@@ -0,0 +1,125 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// identityMapping stores the value of a header, or of a JSON path inside a JSON header, in a user field.
+type identityMapping struct {
+	header string
+	// path is the dotted path of the value inside the JSON header. The header value is used as is when empty.
+	path  []string
+	field string
+}
+
+// identityExtractor reads the identity set in request headers by an authentication proxy, such as
+// Traefik ForwardAuth or Ory Oathkeeper.
+type identityExtractor struct {
+	mappings []identityMapping
+}
+
+func newIdentityExtractor(mappings []string) (*identityExtractor, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	e := &identityExtractor{}
+	for _, mapping := range mappings {
+		i := strings.LastIndexByte(mapping, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid identity header mapping %q: missing field", mapping)
+		}
+		source, field := strings.TrimSpace(mapping[:i]), strings.TrimSpace(mapping[i+1:])
+		header, path := source, ""
+		if j := strings.IndexByte(source, ':'); j >= 0 {
+			header, path = strings.TrimSpace(source[:j]), strings.TrimSpace(source[j+1:])
+		}
+		if header == "" || field == "" || (path == "" && header != source) {
+			return nil, fmt.Errorf("invalid identity header mapping %q", mapping)
+		}
+
+		m := identityMapping{header: http.CanonicalHeaderKey(header), field: field}
+		if path != "" {
+			m.path = strings.Split(path, ".")
+		}
+		e.mappings = append(e.mappings, m)
+	}
+	return e, nil
+}
+
+// extract adds the mapped header values of the request to user, which may be nil, and returns it.
+func (e *identityExtractor) extract(req *http.Request, user *User) *User {
+	if e == nil {
+		return user
+	}
+
+	identity := user
+	if identity == nil {
+		identity = &User{}
+	}
+	documents := make(map[string]interface{})
+	for _, m := range e.mappings {
+		value := req.Header.Get(m.header)
+		if value == "" {
+			continue
+		}
+		if m.path == nil {
+			identity.set(m.field, value)
+			continue
+		}
+
+		document, ok := documents[m.header]
+		if !ok {
+			document = decodeIdentityHeader(value)
+			documents[m.header] = document
+		}
+		if v := jsonPath(document, m.path); v != nil {
+			identity.set(m.field, v)
+		}
+	}
+
+	if identity.empty() {
+		return user
+	}
+	return identity
+}
+
+// decodeIdentityHeader decodes a JSON header value, optionally base64 encoded. It returns nil when the
+// value is neither.
+func decodeIdentityHeader(value string) interface{} {
+	var document interface{}
+	if json.Unmarshal([]byte(value), &document) == nil {
+		return document
+	}
+
+	trimmed := strings.TrimRight(value, "=")
+	for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		decoded, err := encoding.DecodeString(trimmed)
+		if err != nil {
+			continue
+		}
+		if json.Unmarshal(decoded, &document) == nil {
+			return document
+		}
+	}
+	return nil
+}
+
+// jsonPath returns the value at path inside a decoded JSON document, or nil when there is none.
+func jsonPath(document interface{}, path []string) interface{} {
+	for _, key := range path {
+		object, ok := document.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		document = object[key]
+	}
+	return document
+}
@@ -0,0 +1,129 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestIdentityHeaders(t *testing.T) {
+	identity := `{"subject":"user-1","traits":{"email":"alice@example.com","tenant":"acme"},"roles":["admin"]}`
+
+	testCases := []struct {
+		desc     string
+		headers  map[string]string
+		expected interface{}
+	}{
+		{
+			desc:     "plain headers",
+			headers:  map[string]string{"X-User-Id": "user-1", "X-Forwarded-User": "alice", "X-User-Roles": "admin, editor"},
+			expected: map[string]interface{}{"id": "user-1", "name": "alice", "roles": []interface{}{"admin", "editor"}},
+		},
+		{
+			desc:    "base64 JSON header",
+			headers: map[string]string{"X-User": base64.StdEncoding.EncodeToString([]byte(identity))},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin"},
+				"claims": map[string]interface{}{"tenant": "acme"},
+			},
+		},
+		{
+			desc:    "JSON header",
+			headers: map[string]string{"X-User": identity},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin"},
+				"claims": map[string]interface{}{"tenant": "acme"},
+			},
+		},
+		{
+			desc:    "malformed JSON header",
+			headers: map[string]string{"X-User": "not json"},
+		},
+		{
+			desc: "no identity",
+		},
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.IdentityHeaders = []string{
+		"X-User-Id=id",
+		"X-Forwarded-User=name",
+		"X-User-Roles=roles",
+		"X-User:subject=id",
+		"X-User:traits.email=email",
+		"X-User:traits.tenant=tenant",
+		"X-User:roles=roles",
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for i, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, i+1)
+			if len(docs) != i+1 {
+				t.Fatalf("expected %d indexed documents, got %d", i+1, len(docs))
+			}
+
+			if got := docs[i]["user"]; !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestIdentityHeadersCompleteJWTClaims(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.Schema = traefik_plugin_elastic.SchemaECS
+	cfg.JWTClaims = []string{"sub"}
+	cfg.IdentityHeaders = []string{"X-User-Email=email"}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+	req.Header.Set("Authorization", "Bearer "+signHS256(t, testClaims, []byte("secret")))
+	req.Header.Set("X-User-Email", "alice@example.com")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 indexed document, got %d", len(docs))
+	}
+
+	expected := map[string]interface{}{"id": "user-1", "email": "alice@example.com"}
+	if got := docs[0]["user"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
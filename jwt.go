@@ -0,0 +1,378 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtClockSkew is the clock difference allowed with the token issuer when checking the exp and nbf claims.
+const jwtClockSkew = time.Minute
+
+// jwtUserFields maps the registered and common JWT claims to the user fields they are stored in.
+// Other claims are stored under user.claims.
+var jwtUserFields = map[string]string{
+	"sub":                "id",
+	"preferred_username": "name",
+	"name":               "full_name",
+	"email":              "email",
+	"roles":              "roles",
+}
+
+// jwtClaim is a claim extracted from tokens and the user field it is stored in.
+type jwtClaim struct {
+	name  string
+	field string
+}
+
+// jwtExtractor decodes the claims of the bearer token of a request. The token itself is never kept.
+type jwtExtractor struct {
+	claims []jwtClaim
+	cookie string
+	// keys verify the token signatures. Signatures are not verified when it is empty.
+	keys []*jwk
+}
+
+// jwk is a verification key, optionally identified by a key ID.
+type jwk struct {
+	id  string
+	key interface{}
+}
+
+func newJWTExtractor(claims []string, cookie, jwksFile, key string) (*jwtExtractor, error) {
+	if len(claims) == 0 {
+		return nil, nil
+	}
+
+	e := &jwtExtractor{cookie: cookie}
+	for _, claim := range claims {
+		name, field := claim, ""
+		if i := strings.IndexByte(claim, '='); i >= 0 {
+			name, field = strings.TrimSpace(claim[:i]), strings.TrimSpace(claim[i+1:])
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid JWT claim: %q", claim)
+		}
+		if field == "" {
+			if field = jwtUserFields[name]; field == "" {
+				field = name
+			}
+		}
+		e.claims = append(e.claims, jwtClaim{name: name, field: field})
+	}
+
+	if jwksFile != "" {
+		keys, err := loadJWKS(jwksFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading JWKS %s: %w", jwksFile, err)
+		}
+		e.keys = append(e.keys, keys...)
+	}
+	if key != "" {
+		k, err := parseStaticKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT key: %w", err)
+		}
+		e.keys = append(e.keys, &jwk{key: k})
+	}
+
+	return e, nil
+}
+
+// extract returns the user described by the configured claims of the request token, or nil when the
+// request has no token, the token is malformed, or its signature cannot be verified or it is expired.
+func (e *jwtExtractor) extract(req *http.Request) *User {
+	if e == nil {
+		return nil
+	}
+
+	token := e.token(req)
+	if token == "" {
+		return nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	if len(e.keys) > 0 && !e.verify(parts) {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	if len(e.keys) > 0 && !validJWTTime(claims, time.Now()) {
+		return nil
+	}
+
+	user := &User{}
+	for _, claim := range e.claims {
+		if value, ok := claims[claim.name]; ok && value != nil {
+			user.set(claim.field, value)
+		}
+	}
+	if user.empty() {
+		return nil
+	}
+	return user
+}
+
+// token returns the bearer token of the Authorization header, or the value of the configured cookie.
+func (e *jwtExtractor) token(req *http.Request) string {
+	if e.cookie != "" {
+		if cookie, err := req.Cookie(e.cookie); err == nil {
+			return cookie.Value
+		}
+		return ""
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// verify reports whether the signature of the token is valid for one of the configured keys.
+func (e *jwtExtractor) verify(parts []string) bool {
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return false
+	}
+	var h struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return false
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	for _, k := range e.keys {
+		if h.Kid != "" && k.id != "" && k.id != h.Kid {
+			continue
+		}
+		if verifyJWTSignature(h.Alg, k.key, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// validJWTTime reports whether now is within the validity period set by the exp and nbf claims, give
+// or take jwtClockSkew. Claims that are not numbers make the token invalid.
+func validJWTTime(claims map[string]interface{}, now time.Time) bool {
+	if value, ok := claims["exp"]; ok {
+		exp, ok := value.(float64)
+		if !ok || now.Add(-jwtClockSkew).After(time.Unix(int64(exp), 0)) {
+			return false
+		}
+	}
+	if value, ok := claims["nbf"]; ok {
+		nbf, ok := value.(float64)
+		if !ok || now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyJWTSignature verifies signature with key using the JWS algorithm alg. The none algorithm is rejected.
+func verifyJWTSignature(alg string, key interface{}, signed, signature []byte) bool {
+	var hashFunc crypto.Hash
+	switch alg {
+	case "HS256", "RS256", "PS256", "ES256":
+		hashFunc = crypto.SHA256
+	case "HS384", "RS384", "PS384", "ES384":
+		hashFunc = crypto.SHA384
+	case "HS512", "RS512", "PS512", "ES512":
+		hashFunc = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, signature)
+	default:
+		return false
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		if alg[0] != 'H' {
+			return false
+		}
+		mac := hmac.New(newHash(hashFunc), k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		digest := digest(hashFunc, signed)
+		switch alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(k, hashFunc, digest, signature) == nil
+		case 'P':
+			return rsa.VerifyPSS(k, hashFunc, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest(hashFunc, signed), r, s)
+	}
+	return false
+}
+
+func newHash(h crypto.Hash) func() hash.Hash {
+	switch h {
+	case crypto.SHA384:
+		return sha512.New384
+	case crypto.SHA512:
+		return sha512.New
+	default:
+		return sha256.New
+	}
+}
+
+func digest(h crypto.Hash, data []byte) []byte {
+	d := newHash(h)()
+	d.Write(data)
+	return d.Sum(nil)
+}
+
+// parseStaticKey parses a PEM-encoded public key or certificate. Any other value is used as an HMAC secret.
+func parseStaticKey(key string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return []byte(key), nil
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// loadJWKS reads the keys of a JSON Web Key Set file. Keys of unsupported types are ignored.
+func loadJWKS(path string) ([]*jwk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []*jwk
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			n, e := decodeBigInt(k.N), decodeBigInt(k.E)
+			if n == nil || e == nil {
+				return nil, fmt.Errorf("invalid RSA key %q", k.Kid)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, y := decodeBigInt(k.X), decodeBigInt(k.Y)
+			if x == nil || y == nil {
+				return nil, fmt.Errorf("invalid EC key %q", k.Kid)
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("invalid symmetric key %q", k.Kid)
+			}
+			key = secret
+		default:
+			continue
+		}
+		keys = append(keys, &jwk{id: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(value string) *big.Int {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
@@ -0,0 +1,336 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+var testClaims = map[string]interface{}{
+	"sub":    "user-1",
+	"iss":    "https://auth.example.com",
+	"aud":    []interface{}{"api"},
+	"email":  "alice@example.com",
+	"roles":  []interface{}{"admin", "editor"},
+	"tenant": "acme",
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("secret")
+	token := signHS256(t, testClaims, secret)
+
+	testCases := []struct {
+		desc     string
+		update   func(cfg *traefik_plugin_elastic.Config)
+		request  func(req *http.Request)
+		expected interface{}
+	}{
+		{
+			desc: "bearer token",
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+token)
+			},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin", "editor"},
+				"domain": "acme",
+				"claims": map[string]interface{}{"iss": "https://auth.example.com", "aud": []interface{}{"api"}},
+			},
+		},
+		{
+			desc:   "cookie",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTCookie = "session" },
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer ignored")
+				req.AddCookie(&http.Cookie{Name: "session", Value: token})
+			},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin", "editor"},
+				"domain": "acme",
+				"claims": map[string]interface{}{"iss": "https://auth.example.com", "aud": []interface{}{"api"}},
+			},
+		},
+		{
+			desc:   "verified signature",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = string(secret) },
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+token)
+			},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin", "editor"},
+				"domain": "acme",
+				"claims": map[string]interface{}{"iss": "https://auth.example.com", "aud": []interface{}{"api"}},
+			},
+		},
+		{
+			desc:   "expired token",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = string(secret) },
+			request: func(req *http.Request) {
+				claims := withClaims(map[string]interface{}{"exp": time.Now().Add(-2 * time.Minute).Unix()})
+				req.Header.Set("Authorization", "Bearer "+signHS256(t, claims, secret))
+			},
+		},
+		{
+			desc:   "token not valid yet",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = string(secret) },
+			request: func(req *http.Request) {
+				claims := withClaims(map[string]interface{}{"nbf": time.Now().Add(2 * time.Minute).Unix()})
+				req.Header.Set("Authorization", "Bearer "+signHS256(t, claims, secret))
+			},
+		},
+		{
+			desc:   "token expired within the clock skew",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = string(secret) },
+			request: func(req *http.Request) {
+				claims := withClaims(map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()})
+				req.Header.Set("Authorization", "Bearer "+signHS256(t, claims, secret))
+			},
+			expected: map[string]interface{}{
+				"id":     "user-1",
+				"email":  "alice@example.com",
+				"roles":  []interface{}{"admin", "editor"},
+				"domain": "acme",
+				"claims": map[string]interface{}{"iss": "https://auth.example.com", "aud": []interface{}{"api"}},
+			},
+		},
+		{
+			desc:   "invalid signature",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = "other secret" },
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+token)
+			},
+		},
+		{
+			desc:   "unsigned token",
+			update: func(cfg *traefik_plugin_elastic.Config) { cfg.JWTKey = string(secret) },
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer "+encodeJWT(t, map[string]interface{}{"alg": "none"}, testClaims)+".")
+			},
+		},
+		{
+			desc: "malformed token",
+			request: func(req *http.Request) {
+				req.Header.Set("Authorization", "Bearer not-a-token")
+			},
+		},
+		{
+			desc: "no token",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.JWTClaims = []string{"sub", "iss", "aud", "email", "roles", "tenant=domain", "missing"}
+			cfg.CaptureHeaders = true
+			if test.update != nil {
+				test.update(cfg)
+			}
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			if test.request != nil {
+				test.request(req)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			if got := docs[0]["user"]; !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, got)
+			}
+
+			raw, err := json.Marshal(docs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(raw), token) {
+				t.Errorf("the token was indexed: %s", raw)
+			}
+		})
+	}
+}
+
+func TestJWTClaimsVerifiedWithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	set := map[string]interface{}{
+		"keys": []interface{}{
+			map[string]interface{}{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			},
+		},
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jwks, data, 0o600); err != nil {
+		t.Fatalf("Could not write the JWKS: %v", err)
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.Schema = traefik_plugin_elastic.SchemaECS
+	cfg.JWTClaims = []string{"sub"}
+	cfg.JWTJWKSFile = jwks
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for _, kid := range []string{"key-1", "key-2"} {
+		req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+		req.Header.Set("Authorization", "Bearer "+signRS256(t, kid, testClaims, key))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	docs := es.WaitForDocuments(t, 2)
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 indexed documents, got %d", len(docs))
+	}
+
+	if got := lookup(docs[0], "user.id"); got != "user-1" {
+		t.Errorf("expected user.id user-1, got %v", got)
+	}
+	if got := docs[1]["user"]; got != nil {
+		t.Errorf("expected no user for an unknown key, got %v", got)
+	}
+}
+
+func TestJWTKeyFromPEM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.JWTClaims = []string{"sub"}
+	cfg.JWTKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+	req.Header.Set("Authorization", "Bearer "+signRS256(t, "", testClaims, key))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 indexed document, got %d", len(docs))
+	}
+	if got := lookup(docs[0], "user.id"); got != "user-1" {
+		t.Errorf("expected user.id user-1, got %v", got)
+	}
+}
+
+// withClaims returns testClaims with extra claims added.
+func withClaims(extra map[string]interface{}) map[string]interface{} {
+	claims := make(map[string]interface{}, len(testClaims)+len(extra))
+	for name, value := range testClaims {
+		claims[name] = value
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	return claims
+}
+
+func encodeJWT(t *testing.T, header, claims map[string]interface{}) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func signHS256(t *testing.T, claims map[string]interface{}, secret []byte) string {
+	t.Helper()
+
+	signed := encodeJWT(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, kid string, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	header := map[string]interface{}{"alg": "RS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeJWT(t, header, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
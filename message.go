@@ -0,0 +1,99 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// CommonLogFormat is a Message template rendering the request in the Common Log Format.
+	CommonLogFormat = `{{template "common" .}}`
+	// CombinedLogFormat is a Message template rendering the request in the Combined Log Format.
+	CombinedLogFormat = `{{template "combined" .}}`
+
+	clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// messagePresets are the named templates every Message template can invoke.
+const messagePresets = `
+{{- define "common" -}}
+{{dash .ClientIP}} - - [{{clfTime .Timestamp}}] "{{.Method}} {{.Path}}{{if .Query}}?{{.Query}}{{end}} {{.Protocol}}" {{.Status}} {{dash .BytesSent}}
+{{- end -}}
+{{- define "combined" -}}
+{{template "common" .}} "{{dash .Referer}}" "{{dash .UserAgent}}"
+{{- end -}}`
+
+var messageFuncs = template.FuncMap{
+	"clfTime": func(t time.Time) string { return t.Format(clfTimeLayout) },
+	"dash":    dash,
+}
+
+// newMessageTemplate parses text as the Message template of a middleware. The template is
+// executed against sampleDocument so that references to unknown fields fail here rather
+// than at request time.
+func newMessageTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("message").Funcs(messageFuncs).Parse(messagePresets)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl, err = tmpl.Parse(text); err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, sampleDocument()); err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+// sampleDocument returns a Document whose optional parts are all set, so that templates
+// reading fields through them, such as {{.User.ID}} or {{.Geo.CityName}}, can be checked.
+func sampleDocument() *Document {
+	return &Document{
+		ForwardedFor: []string{""},
+		Geo:          &Geo{Location: &GeoLocation{}},
+		AS:           &AS{Organization: &ASOrganization{}},
+		UserAgentDetails: &UserAgent{
+			OS:     &UserAgentOS{},
+			Device: &UserAgentDevice{},
+		},
+		User:            &User{Roles: []string{""}, Claims: map[string]interface{}{}},
+		GraphQL:         []GraphQLOperation{{Fields: []string{""}, Variables: map[string]interface{}{}}},
+		Trace:           &Identifier{},
+		Parent:          &Identifier{},
+		Transaction:     &Identifier{},
+		Span:            &Identifier{},
+		RequestHeaders:  map[string]string{},
+		RequestBody:     &Body{},
+		ResponseHeaders: map[string]string{},
+		ResponseBody:    &Body{},
+	}
+}
+
+// renderMessage executes tmpl against doc. It renders "-" when the template fails, for
+// example because doc lacks a part the template reads.
+func renderMessage(tmpl *template.Template, doc *Document) string {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, doc); err != nil {
+		log.Printf("Error rendering the log message: %s", err)
+		return "-"
+	}
+
+	return b.String()
+}
+
+// dash renders empty strings and zero numbers as "-", as the Common Log Format does.
+func dash(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || s == "0" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestMessageTemplate(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		message  string
+		expected string
+	}{
+		{
+			desc:     "static message",
+			message:  "Test Elasticsearch",
+			expected: `^Test Elasticsearch$`,
+		},
+		{
+			desc:     "request and response fields",
+			message:  "{{.Method}} {{.Path}} -> {{.Status}} in {{.Duration}}",
+			expected: `^GET /foo -> 404 in \d+(\.\d+)?[nµm]?s$`,
+		},
+		{
+			desc:     "common log format",
+			message:  traefik_plugin_elastic.CommonLogFormat,
+			expected: `^10\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /foo\?bar=baz HTTP/1\.1" 404 8$`,
+		},
+		{
+			desc:     "combined log format",
+			message:  traefik_plugin_elastic.CombinedLogFormat,
+			expected: `^10\.0\.0\.1 - - \[.+\] "GET /foo\?bar=baz HTTP/1\.1" 404 8 "http://example\.com/" "test-agent"$`,
+		},
+		{
+			desc:     "fields of optional parts",
+			message:  "{{.Method}}{{with .Geo}} {{.CityName}}{{end}}{{with .User}} {{.ID}}{{end}}",
+			expected: `^GET$`,
+		},
+		{
+			desc:     "fields of missing optional parts",
+			message:  "{{.Method}} {{.User.ID}} {{.Trace.ID}} {{.Geo.CityName}}",
+			expected: `^-$`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.Message = test.message
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "missing", http.StatusNotFound)
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo?bar=baz", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("User-Agent", "test-agent")
+			req.Header.Set("Referer", "http://example.com/")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			message, _ := docs[0]["message"].(string)
+			if !regexp.MustCompile(test.expected).MatchString(message) {
+				t.Errorf("expected message matching %s, got %q", test.expected, message)
+			}
+		})
+	}
+}
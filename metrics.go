@@ -0,0 +1,158 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// dropLogInterval is the minimum time between two log lines about dropped documents, so that a
+// saturated queue does not flood the Traefik log.
+const dropLogInterval = 10 * time.Second
+
+// Metrics is a snapshot of the delivery counters of a pipeline, shared by the middleware instances
+// with an identical configuration.
+type Metrics struct {
+	// Indexed is the number of documents acknowledged by Elasticsearch.
+	Indexed int64
+	// Dropped is the number of documents dropped by the queue policy, the sum of the following counters.
+	Dropped int64
+	// DroppedQueueFull is the number of new documents dropped because the queue held QueueSize documents.
+	DroppedQueueFull int64
+	// DroppedQueueBytes is the number of new documents dropped because the queue held QueueMaxBytes.
+	DroppedQueueBytes int64
+	// DroppedEvicted is the number of queued documents dropped to make room for new ones.
+	DroppedEvicted int64
+	// DroppedTimeout is the number of documents dropped after waiting QueueBlockTimeout for room in the queue.
+	DroppedTimeout int64
+	// DroppedSampled is the number of documents left out by sampling.
+	DroppedSampled int64
+	// DroppedShutdown is the number of documents of requests served after the middleware was shut down.
+	DroppedShutdown int64
+	// DroppedRetries is the number of failed documents dropped instead of being retried, without a spool,
+	// because the documents waiting to be retried held QueueMaxBytes.
+	DroppedRetries int64
+	// Failed is the number of documents that could not be indexed and were given up on.
+	Failed int64
+	// DeadLettered is the number of failed documents written to the dead-letter destination.
+	DeadLettered int64
+	// Spooled is the number of documents written to the spool after failed deliveries. Spooled, SpoolDropped
+	// and SpoolBytes count the documents of every configuration spooling to the same directory.
+	Spooled int64
+	// SpoolDropped is the number of spooled documents lost because the spool was full, they were too old,
+	// or their segment was corrupted.
+	SpoolDropped int64
+	// SpoolBytes is the current size of the spool.
+	SpoolBytes int64
+	// Rejected is the number of requests rejected because the middleware is in fail-closed mode
+	// and documents could not be delivered.
+	Rejected int64
+	// CircuitBreakerState is the state of the circuit breaker: closed, open or half-open.
+	CircuitBreakerState string
+	// CircuitBreakerOpened, CircuitBreakerHalfOpened and CircuitBreakerClosed count the transitions of
+	// the circuit breaker to each state.
+	CircuitBreakerOpened     int64
+	CircuitBreakerHalfOpened int64
+	CircuitBreakerClosed     int64
+	// ShortCircuited is the number of requests to Elasticsearch not sent because the circuit breaker was open.
+	ShortCircuited int64
+}
+
+// metrics holds the live counters shared by the request path and the pipeline workers.
+// All fields are accessed atomically.
+type metrics struct {
+	indexed int64
+	dropped int64
+
+	droppedQueueFull  int64
+	droppedQueueBytes int64
+	droppedEvicted    int64
+	droppedTimeout    int64
+	droppedSampled    int64
+	droppedShutdown   int64
+	droppedRetries    int64
+	failed            int64
+	rejected          int64
+	// droppedLoggedAt is when dropped documents were last logged, in Unix nanoseconds.
+	droppedLoggedAt int64
+
+	deadLettered int64
+
+	circuitState      int32
+	circuitOpened     int64
+	circuitHalfOpened int64
+	circuitClosed     int64
+	shortCircuited    int64
+
+	// failing is set to 1 while requests to Elasticsearch fail, and back to 0 on the next success.
+	failing int32
+
+	// spool is the spool whose counters are reported, if any. It is set before the pipeline starts.
+	spool *spool
+}
+
+func (m *metrics) snapshot() Metrics {
+	spooled, spoolDropped, spoolBytes := m.spool.counters()
+	return Metrics{
+		Indexed: atomic.LoadInt64(&m.indexed),
+		Dropped: atomic.LoadInt64(&m.dropped),
+
+		DroppedQueueFull:  atomic.LoadInt64(&m.droppedQueueFull),
+		DroppedQueueBytes: atomic.LoadInt64(&m.droppedQueueBytes),
+		DroppedEvicted:    atomic.LoadInt64(&m.droppedEvicted),
+		DroppedTimeout:    atomic.LoadInt64(&m.droppedTimeout),
+		DroppedSampled:    atomic.LoadInt64(&m.droppedSampled),
+		DroppedShutdown:   atomic.LoadInt64(&m.droppedShutdown),
+		DroppedRetries:    atomic.LoadInt64(&m.droppedRetries),
+
+		Failed:       atomic.LoadInt64(&m.failed),
+		DeadLettered: atomic.LoadInt64(&m.deadLettered),
+		Spooled:      spooled,
+		SpoolDropped: spoolDropped,
+		SpoolBytes:   spoolBytes,
+		Rejected:     atomic.LoadInt64(&m.rejected),
+
+		CircuitBreakerState:      circuitState(atomic.LoadInt32(&m.circuitState)).String(),
+		CircuitBreakerOpened:     atomic.LoadInt64(&m.circuitOpened),
+		CircuitBreakerHalfOpened: atomic.LoadInt64(&m.circuitHalfOpened),
+		CircuitBreakerClosed:     atomic.LoadInt64(&m.circuitClosed),
+		ShortCircuited:           atomic.LoadInt64(&m.shortCircuited),
+	}
+}
+
+// logDropped logs that documents are being dropped for reason, along with the drop counters, unless
+// drops were already logged within dropLogInterval.
+func (m *metrics) logDropped(reason string) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&m.droppedLoggedAt)
+	if last != 0 && now-last < int64(dropLogInterval) || !atomic.CompareAndSwapInt64(&m.droppedLoggedAt, last, now) {
+		return
+	}
+
+	log.Printf("Dropping documents: %s (dropped=%d queue_full=%d queue_bytes=%d evicted=%d timeout=%d sampled=%d shutdown=%d retries=%d)",
+		reason,
+		atomic.LoadInt64(&m.dropped),
+		atomic.LoadInt64(&m.droppedQueueFull),
+		atomic.LoadInt64(&m.droppedQueueBytes),
+		atomic.LoadInt64(&m.droppedEvicted),
+		atomic.LoadInt64(&m.droppedTimeout),
+		atomic.LoadInt64(&m.droppedSampled),
+		atomic.LoadInt64(&m.droppedShutdown),
+		atomic.LoadInt64(&m.droppedRetries),
+	)
+}
+
+func (m *metrics) setFailing(failing bool) {
+	var v int32
+	if failing {
+		v = 1
+	}
+	atomic.StoreInt32(&m.failing, v)
+}
+
+func (m *metrics) isFailing() bool {
+	return atomic.LoadInt32(&m.failing) == 1
+}
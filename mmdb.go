@@ -0,0 +1,347 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSectionSeparator is the number of zero bytes between the search tree and the data section.
+const mmdbDataSectionSeparator = 16
+
+// mmdbMaxDepth bounds the nesting of decoded values, so that a corrupted database cannot
+// recurse forever through pointers.
+const mmdbMaxDepth = 32
+
+// mmdbReader is a minimal, pure Go reader of the MaxMind DB format
+// (https://maxmind.github.io/MaxMind-DB/). The whole database is held in memory.
+type mmdbReader struct {
+	buffer       []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	databaseType string
+	treeSize     uint
+	dataOffset   uint
+	ipv4Start    uint
+}
+
+// newMMDBReader parses the metadata of the database held in buffer.
+func newMMDBReader(buffer []byte) (*mmdbReader, error) {
+	start := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if start < 0 {
+		return nil, errors.New("invalid MaxMind DB: metadata not found")
+	}
+	start += len(mmdbMetadataMarker)
+
+	metadataDecoder := mmdbDecoder{buffer: buffer[start:]}
+	value, _, err := metadataDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata: expected a map")
+	}
+
+	r := &mmdbReader{
+		buffer:       buffer,
+		nodeCount:    mmdbUint(metadata["node_count"]),
+		recordSize:   mmdbUint(metadata["record_size"]),
+		ipVersion:    mmdbUint(metadata["ip_version"]),
+		databaseType: mmdbString(metadata["database_type"]),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("invalid MaxMind DB: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("invalid MaxMind DB: unsupported IP version %d", r.ipVersion)
+	}
+
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	r.dataOffset = r.treeSize + mmdbDataSectionSeparator
+	if r.dataOffset > uint(len(buffer)) {
+		return nil, errors.New("invalid MaxMind DB: search tree is larger than the file")
+	}
+
+	// IPv4 addresses are stored in IPv6 trees under ::/96.
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			if node, err = r.readNode(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// lookup returns the record of ip, or nil when the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+	var (
+		node    uint
+		address = ip.To4()
+	)
+	if address != nil && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if address == nil {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		address = ip.To16()
+	}
+
+	bitCount := uint(len(address) * 8)
+	for i := uint(0); i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(address[i>>3]>>(7-(i%8))) & 1
+
+		var err error
+		if node, err = r.readNode(node, bit); err != nil {
+			return nil, err
+		}
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errors.New("invalid MaxMind DB: search tree is deeper than the address")
+	}
+
+	offset := node - r.nodeCount - mmdbDataSectionSeparator
+	decoder := mmdbDecoder{buffer: r.buffer[r.dataOffset:]}
+	value, _, err := decoder.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) readNode(node, bit uint) (uint, error) {
+	offset := node * r.recordSize / 4
+	if offset+r.recordSize/4 > r.treeSize || r.treeSize > uint(len(r.buffer)) {
+		return 0, errors.New("invalid MaxMind DB: node outside of the search tree")
+	}
+	b := r.buffer[offset:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// mmdbDecoder decodes values of the MaxMind DB data section format.
+type mmdbDecoder struct {
+	buffer []byte
+}
+
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+var errMMDBTruncated = errors.New("invalid MaxMind DB: unexpected end of data")
+
+// decode decodes the value at offset and returns it with the offset following it.
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("invalid MaxMind DB: data is nested too deeply")
+	}
+
+	kind, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if kind == mmdbTypePointer {
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, next, err
+	}
+
+	switch kind {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[mmdbString(key)] = value
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	end := offset + size
+	if end > uint(len(d.buffer)) || end < offset {
+		return nil, 0, errMMDBTruncated
+	}
+	b := d.buffer[offset:end]
+
+	switch kind {
+	case mmdbTypeString:
+		return string(b), end, nil
+	case mmdbTypeBytes:
+		return append([]byte(nil), b...), end, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid MaxMind DB: double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid MaxMind DB: float of %d bytes", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), end, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64, mmdbTypeInt32:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if kind == mmdbTypeInt32 {
+			return int64(int32(uint32(v))), end, nil
+		}
+		return v, end, nil
+	case mmdbTypeUint128:
+		// 128-bit integers are not needed for enrichment and are kept as raw bytes.
+		return append([]byte(nil), b...), end, nil
+	default:
+		return nil, 0, fmt.Errorf("invalid MaxMind DB: unexpected data type %d", kind)
+	}
+}
+
+// decodeControl decodes the control byte, and the extended type and size bytes that follow it.
+func (d mmdbDecoder) decodeControl(offset uint) (kind, size, next uint, err error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, 0, 0, errMMDBTruncated
+	}
+	control := d.buffer[offset]
+	offset++
+
+	kind = uint(control >> 5)
+	if kind == mmdbTypePointer {
+		return kind, uint(control & 0x1f), offset, nil
+	}
+	if kind == mmdbTypeExtended {
+		if offset >= uint(len(d.buffer)) {
+			return 0, 0, 0, errMMDBTruncated
+		}
+		kind = uint(d.buffer[offset]) + 7
+		offset++
+	}
+
+	size = uint(control & 0x1f)
+	if size < 29 {
+		return kind, size, offset, nil
+	}
+
+	extra := size - 28
+	if offset+extra > uint(len(d.buffer)) {
+		return 0, 0, 0, errMMDBTruncated
+	}
+	var v uint
+	for _, c := range d.buffer[offset : offset+extra] {
+		v = v<<8 | uint(c)
+	}
+	switch extra {
+	case 1:
+		size = 29 + v
+	case 2:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+
+	return kind, size, offset + extra, nil
+}
+
+// decodePointer decodes a pointer whose control byte carried bits, and returns the offset it
+// points to and the offset following it.
+func (d mmdbDecoder) decodePointer(bits, offset uint) (uint, uint, error) {
+	length := bits>>3 + 1
+	if offset+length > uint(len(d.buffer)) {
+		return 0, 0, errMMDBTruncated
+	}
+
+	var v uint
+	for _, c := range d.buffer[offset : offset+length] {
+		v = v<<8 | uint(c)
+	}
+
+	switch length {
+	case 1:
+		v |= (bits & 0x7) << 8
+	case 2:
+		v = (bits&0x7)<<16 | v + 2048
+	case 3:
+		v = (bits&0x7)<<24 | v + 526336
+	}
+
+	return v, offset + length, nil
+}
+
+func mmdbUint(value interface{}) uint {
+	v, _ := value.(uint64)
+	return uint(v)
+}
+
+func mmdbString(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
@@ -0,0 +1,386 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PolicyDropOldest makes room for new documents by dropping the oldest ones.
+	PolicyDropOldest = "drop-oldest"
+	// PolicyDropNewest drops new documents while there is no room left for them.
+	PolicyDropNewest = "drop-newest"
+	// PolicyBlock makes requests wait for room in the queue, up to a deadline, before dropping their documents.
+	PolicyBlock = "block"
+	// PolicySample keeps only a sample of the documents once the queue is half full, and drops new
+	// documents while it is full.
+	PolicySample = "sample"
+
+	defaultQueueSize         = 1000
+	defaultQueueMaxBytes     = 32 << 20
+	defaultQueuePolicy       = PolicyDropNewest
+	defaultQueueBlockTimeout = "100ms"
+	defaultQueueSampleRate   = 0.1
+	defaultWorkers           = 1
+)
+
+// queuedDocument is a document in the pipeline queue, with its estimated size.
+type queuedDocument struct {
+	doc  *Document
+	size int64
+}
+
+// queueOptions configures the bounds of the pipeline queue and what happens when they are reached.
+type queueOptions struct {
+	size         int
+	maxBytes     int64
+	policy       string
+	blockTimeout time.Duration
+	sampleRate   float64
+}
+
+func newQueueOptions(config *Config) (queueOptions, error) {
+	opts := queueOptions{
+		size:       config.QueueSize,
+		maxBytes:   config.QueueMaxBytes,
+		policy:     config.QueuePolicy,
+		sampleRate: config.QueueSampleRate,
+	}
+	if opts.size <= 0 {
+		opts.size = defaultQueueSize
+	}
+	if opts.maxBytes < 0 {
+		return opts, fmt.Errorf("invalid queue size in bytes: %d", opts.maxBytes)
+	}
+	if opts.maxBytes == 0 {
+		opts.maxBytes = defaultQueueMaxBytes
+	}
+	if opts.policy == "" {
+		opts.policy = defaultQueuePolicy
+	}
+	switch opts.policy {
+	case PolicyDropNewest, PolicyDropOldest, PolicyBlock, PolicySample:
+	default:
+		return opts, fmt.Errorf("unknown queue policy %q: expected drop-newest, drop-oldest, block or sample", opts.policy)
+	}
+	var err error
+	if opts.blockTimeout, err = parseDuration(config.QueueBlockTimeout, defaultQueueBlockTimeout); err != nil {
+		return opts, fmt.Errorf("invalid queue block timeout: %w", err)
+	}
+	if opts.sampleRate < 0 || opts.sampleRate > 1 {
+		return opts, fmt.Errorf("invalid queue sample rate %v: expected a value between 0 and 1", opts.sampleRate)
+	}
+	if opts.sampleRate == 0 {
+		opts.sampleRate = defaultQueueSampleRate
+	}
+	return opts, nil
+}
+
+// pipeline decouples the request path from the delivery of documents to Elasticsearch.
+// Documents are pushed onto a queue bounded by count and by size, and delivered by background
+// workers, each batching them through its own bulk indexer.
+type pipeline struct {
+	queue         chan queuedDocument
+	opts          queueOptions
+	flushInterval time.Duration
+	metrics       *metrics
+	// bytes is the estimated size of the queued documents, accessed atomically.
+	bytes int64
+	// room is signaled when a worker takes a document off the queue, to wake up a blocked request.
+	room chan struct{}
+	// spool holds the documents that could not be delivered, if set. Workers drain it when the queue is empty.
+	spool *spool
+	// deadLetters is closed along with the pipeline, if set.
+	deadLetters deadLetterSink
+
+	// mu guards stopped: enqueue holds it for reading so that no document is queued once stop returns.
+	mu      sync.RWMutex
+	stopped bool
+	// done is closed to make the workers deliver the documents left and exit, within shutdownTimeout.
+	done            chan struct{}
+	shutdownTimeout time.Duration
+	// cancel cancels the requests of the workers, once shutdownTimeout has elapsed.
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// newPipeline creates a pipeline with a queue bounded as configured by opts and starts one
+// worker per indexer. The indexers must share s.
+func newPipeline(opts queueOptions, flushInterval time.Duration, indexers []*bulkIndexer, m *metrics, s *spool) *pipeline {
+	p := &pipeline{
+		queue:         make(chan queuedDocument, opts.size),
+		opts:          opts,
+		flushInterval: flushInterval,
+		metrics:       m,
+		room:          make(chan struct{}, 1),
+		spool:         s,
+		done:          make(chan struct{}),
+	}
+	p.workers.Add(len(indexers))
+	for _, indexer := range indexers {
+		go p.work(indexer)
+	}
+
+	return p
+}
+
+// enqueue hands doc over to the workers, applying the queue policy when the queue is full. It
+// reports whether the document was accepted. Only the block policy makes it wait.
+func (p *pipeline) enqueue(doc *Document) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		p.drop(&p.metrics.droppedShutdown, "the middleware is shut down")
+		return false
+	}
+
+	q := queuedDocument{doc: doc, size: doc.size()}
+
+	switch p.opts.policy {
+	case PolicyDropOldest:
+		return p.enqueueDroppingOldest(q)
+	case PolicyBlock:
+		return p.enqueueBlocking(q)
+	case PolicySample:
+		if p.fill() >= 0.5 && rand.Float64() >= p.opts.sampleRate { //nolint:gosec // Sampling does not need a secure source of randomness.
+			p.drop(&p.metrics.droppedSampled, "the queue is filling up, sampling documents")
+			return false
+		}
+	}
+	return p.offer(q)
+}
+
+// offer queues q if there is room for it, and drops it otherwise.
+func (p *pipeline) offer(q queuedDocument) bool {
+	if !p.reserve(q.size) {
+		p.drop(&p.metrics.droppedQueueBytes, "the queue has reached its maximum size in bytes")
+		return false
+	}
+	select {
+	case p.queue <- q:
+		return true
+	default:
+		atomic.AddInt64(&p.bytes, -q.size)
+		p.drop(&p.metrics.droppedQueueFull, "the queue is full")
+		return false
+	}
+}
+
+// enqueueDroppingOldest queues q, dropping the oldest queued documents to make room for it.
+func (p *pipeline) enqueueDroppingOldest(q queuedDocument) bool {
+	if q.size > p.opts.maxBytes {
+		p.drop(&p.metrics.droppedQueueBytes, "the document is larger than the queue")
+		return false
+	}
+	for {
+		if p.reserve(q.size) {
+			select {
+			case p.queue <- q:
+				return true
+			default:
+				atomic.AddInt64(&p.bytes, -q.size)
+			}
+		}
+		select {
+		case oldest := <-p.queue:
+			atomic.AddInt64(&p.bytes, -oldest.size)
+			p.drop(&p.metrics.droppedEvicted, "the queue is full, dropping the oldest document")
+		default:
+			// The workers emptied the queue in the meantime.
+		}
+	}
+}
+
+// enqueueBlocking queues q, waiting up to the block timeout for room in the queue.
+func (p *pipeline) enqueueBlocking(q queuedDocument) bool {
+	if q.size > p.opts.maxBytes {
+		p.drop(&p.metrics.droppedQueueBytes, "the document is larger than the queue")
+		return false
+	}
+
+	timer := time.NewTimer(p.opts.blockTimeout)
+	defer timer.Stop()
+
+	for !p.reserve(q.size) {
+		select {
+		case <-p.room:
+		case <-timer.C:
+			p.drop(&p.metrics.droppedTimeout, "timed out waiting for room in the queue")
+			return false
+		}
+	}
+	select {
+	case p.queue <- q:
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&p.bytes, -q.size)
+		p.drop(&p.metrics.droppedTimeout, "timed out waiting for room in the queue")
+		return false
+	}
+}
+
+// reserve adds size to the queued bytes if they stay within the maximum, and reports whether it did.
+func (p *pipeline) reserve(size int64) bool {
+	for {
+		current := atomic.LoadInt64(&p.bytes)
+		if current+size > p.opts.maxBytes {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&p.bytes, current, current+size) {
+			return true
+		}
+	}
+}
+
+// fill returns how full the queue is, by count or by size, between 0 and 1.
+func (p *pipeline) fill() float64 {
+	byCount := float64(len(p.queue)) / float64(cap(p.queue))
+	bySize := float64(atomic.LoadInt64(&p.bytes)) / float64(p.opts.maxBytes)
+	if bySize > byCount {
+		return bySize
+	}
+	return byCount
+}
+
+// drop counts a document dropped for reason in counter.
+func (p *pipeline) drop(counter *int64, reason string) {
+	atomic.AddInt64(counter, 1)
+	atomic.AddInt64(&p.metrics.dropped, 1)
+	p.metrics.logDropped(reason)
+}
+
+// available reports whether documents are currently expected to reach Elasticsearch:
+// the queue has room left and the last request to Elasticsearch succeeded.
+func (p *pipeline) available() bool {
+	return p.fill() < 1 && !p.metrics.isFailing()
+}
+
+// work feeds queued documents to indexer and flushes it every flushInterval, until the pipeline stops.
+func (p *pipeline) work(indexer *bulkIndexer) {
+	defer p.workers.Done()
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	// retry fires when the first retried document is due, so that retries are sent after their backoff
+	// rather than on the next tick.
+	var retry *time.Timer
+	var retryAt time.Time
+	defer func() {
+		if retry != nil {
+			retry.Stop()
+		}
+	}()
+
+	for {
+		var retryC <-chan time.Time
+		if at := indexer.nextRetry(); !at.IsZero() {
+			if retry == nil || !at.Equal(retryAt) {
+				if retry != nil {
+					retry.Stop()
+				}
+				retry, retryAt = time.NewTimer(time.Until(at)), at
+			}
+			retryC = retry.C
+		}
+
+		select {
+		case q := <-p.queue:
+			p.take(q)
+			p.safely(func() { indexer.add(q.doc) })
+		case <-retryC:
+			retry = nil
+			p.safely(indexer.flush)
+		case <-ticker.C:
+			p.safely(indexer.flush)
+			p.safely(indexer.probe)
+			p.drain(indexer)
+		case <-p.done:
+			p.finish(indexer)
+			return
+		}
+	}
+}
+
+// take accounts for q leaving the queue, waking up a request waiting for room.
+func (p *pipeline) take(q queuedDocument) {
+	atomic.AddInt64(&p.bytes, -q.size)
+	select {
+	case p.room <- struct{}{}:
+	default:
+	}
+}
+
+// finish feeds the documents left in the queue to indexer and closes it.
+func (p *pipeline) finish(indexer *bulkIndexer) {
+	for {
+		select {
+		case q := <-p.queue:
+			p.take(q)
+			p.safely(func() { indexer.add(q.doc) })
+		default:
+			p.safely(indexer.close)
+			return
+		}
+	}
+}
+
+// stop stops accepting documents and lets the workers deliver the queued ones within the shutdown
+// timeout, then closes the spool and the dead-letter destination. Documents that could not be
+// delivered in time are spooled, or given up on without a spool.
+func (p *pipeline) stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	close(p.done)
+	p.mu.Unlock()
+
+	deadline := time.AfterFunc(p.shutdownTimeout, p.cancel)
+	p.workers.Wait()
+	deadline.Stop()
+	p.cancel()
+
+	p.spool.close()
+	if p.deadLetters != nil {
+		if err := p.deadLetters.close(); err != nil {
+			log.Printf("Error closing the dead-letter destination: %s", err)
+		}
+	}
+}
+
+// drain sends spooled documents through indexer while the queue is empty, so that live documents
+// are not delayed. While Elasticsearch is failing, only one spool segment is sent every spoolProbeInterval.
+func (p *pipeline) drain(indexer *bulkIndexer) {
+	for p.spool != nil && len(p.queue) == 0 && p.spool.ready(p.metrics.isFailing()) {
+		drained := true
+		p.safely(func() { drained = indexer.drain() })
+		if !drained {
+			return
+		}
+	}
+}
+
+// safely runs f and recovers from any panic in it, so that a delivery bug can never
+// take the Traefik process down.
+func (p *pipeline) safely(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.metrics.failed, 1)
+			log.Printf("Recovered from a panic while delivering documents: %v", r)
+		}
+	}()
+
+	f()
+}
@@ -0,0 +1,216 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestQueuePolicies(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		update   func(cfg *traefik_plugin_elastic.Config)
+		requests int
+		dropped  func(m traefik_plugin_elastic.Metrics) int64
+		expected int64
+	}{
+		{
+			desc:     "drop newest",
+			update:   func(cfg *traefik_plugin_elastic.Config) { cfg.QueuePolicy = traefik_plugin_elastic.PolicyDropNewest },
+			requests: 3,
+			dropped:  func(m traefik_plugin_elastic.Metrics) int64 { return m.DroppedQueueFull },
+			expected: 2,
+		},
+		{
+			desc:     "drop oldest",
+			update:   func(cfg *traefik_plugin_elastic.Config) { cfg.QueuePolicy = traefik_plugin_elastic.PolicyDropOldest },
+			requests: 3,
+			dropped:  func(m traefik_plugin_elastic.Metrics) int64 { return m.DroppedEvicted },
+			expected: 2,
+		},
+		{
+			desc: "block",
+			update: func(cfg *traefik_plugin_elastic.Config) {
+				cfg.QueuePolicy = traefik_plugin_elastic.PolicyBlock
+				cfg.QueueBlockTimeout = "10ms"
+			},
+			requests: 2,
+			dropped:  func(m traefik_plugin_elastic.Metrics) int64 { return m.DroppedTimeout },
+			expected: 1,
+		},
+		{
+			desc: "sample",
+			update: func(cfg *traefik_plugin_elastic.Config) {
+				cfg.QueuePolicy = traefik_plugin_elastic.PolicySample
+				cfg.QueueSize = 2
+				cfg.QueueSampleRate = 1e-9
+			},
+			requests: 3,
+			dropped:  func(m traefik_plugin_elastic.Metrics) int64 { return m.DroppedSampled },
+			expected: 2,
+		},
+		{
+			desc: "size in bytes",
+			update: func(cfg *traefik_plugin_elastic.Config) {
+				cfg.QueueSize = 10
+				cfg.QueueMaxBytes = 1000
+			},
+			requests: 3,
+			dropped:  func(m traefik_plugin_elastic.Metrics) int64 { return m.DroppedQueueBytes },
+			expected: 2,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newStalledElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.QueueSize = 1
+			cfg.FlushDocuments = 1
+			test.update(cfg)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+			elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+			// The first document keeps the worker busy until the end of the test, so that the
+			// next ones pile up in the queue.
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/0", nil))
+			<-es.requests
+
+			for i := 1; i <= test.requests; i++ {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://test.com/"+strconv.Itoa(i), nil))
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected status 200, got %d", w.Code)
+				}
+			}
+
+			metrics := elasticsearchLog.Metrics()
+			if dropped := test.dropped(metrics); dropped != test.expected {
+				t.Errorf("expected %d dropped documents, got %+v", test.expected, metrics)
+			}
+			if metrics.Dropped != test.expected {
+				t.Errorf("expected %d dropped documents in total, got %d", test.expected, metrics.Dropped)
+			}
+		})
+	}
+}
+
+func TestQueueDropOldestKeepsNewestDocument(t *testing.T) {
+	es := newStalledElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.QueueSize = 1
+	cfg.QueuePolicy = traefik_plugin_elastic.PolicyDropOldest
+	cfg.FlushDocuments = 1
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/0", nil))
+	<-es.requests
+
+	for i := 1; i <= 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/"+strconv.Itoa(i), nil))
+	}
+	close(es.release)
+
+	docs := es.WaitForDocuments(t, 2)
+	if len(docs) != 2 || docs[0]["path"] != "/0" || docs[1]["path"] != "/3" {
+		t.Fatalf("expected the first and last documents to be indexed, got %v", docs)
+	}
+}
+
+func TestQueueDropsAreLogged(t *testing.T) {
+	logs := captureLog(t)
+	es := newStalledElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.QueueSize = 1
+	cfg.FlushDocuments = 1
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/0", nil))
+	<-es.requests
+
+	for i := 1; i <= 5; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/"+strconv.Itoa(i), nil))
+	}
+
+	lines := logs.Lines("Dropping documents")
+	if len(lines) != 1 {
+		t.Fatalf("expected the drops to be logged once, got %q", lines)
+	}
+	if !strings.Contains(lines[0], "the queue is full (dropped=1 queue_full=1 ") {
+		t.Errorf("expected the drop counters to be logged, got %q", lines[0])
+	}
+}
+
+// stalledElasticsearch is a fake Elasticsearch node that holds bulk requests until released.
+type stalledElasticsearch struct {
+	*fakeElasticsearch
+
+	// requests receives a value when a bulk request arrives.
+	requests chan struct{}
+	release  chan struct{}
+}
+
+func newStalledElasticsearch(t *testing.T) *stalledElasticsearch {
+	t.Helper()
+
+	es := &stalledElasticsearch{
+		fakeElasticsearch: &fakeElasticsearch{},
+		requests:          make(chan struct{}, 100),
+		release:           make(chan struct{}),
+	}
+	es.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			es.requests <- struct{}{}
+			select {
+			case <-es.release:
+			case <-r.Context().Done():
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = io.WriteString(w, `{"error":"stalled"}`)
+				return
+			}
+		}
+		es.serveHTTP(w, r)
+	}))
+	t.Cleanup(es.Close)
+	t.Cleanup(func() {
+		select {
+		case <-es.release:
+		default:
+			close(es.release)
+		}
+	})
+
+	return es
+}
@@ -0,0 +1,127 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// responseRecorder wraps an http.ResponseWriter and records the outcome of the response
+// written through it. It forwards http.Flusher, http.Hijacker and http.Pusher to the
+// wrapped writer when it supports them.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	start       time.Time
+	firstByte   time.Time
+	status      int
+	size        int64
+	wroteHeader bool
+
+	// bodyCapture decides from the status whether the beginning of the body is kept in body.
+	bodyCapture   *responseBodyCapture
+	bodyCaptured  bool
+	body          []byte
+	bodyTruncated bool
+}
+
+func newResponseRecorder(rw http.ResponseWriter, start time.Time, bodyCapture *responseBodyCapture) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: rw,
+		start:          start,
+		status:         http.StatusOK,
+		bodyCapture:    bodyCapture,
+	}
+}
+
+// WriteHeader records the status code and forwards it to the wrapped writer.
+func (r *responseRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.markFirstByte()
+		// Informational responses may be followed by the final status code.
+		r.wroteHeader = code >= http.StatusOK || code == http.StatusSwitchingProtocols
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write counts the bytes written and forwards them to the wrapped writer.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.markFirstByte()
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+
+	if r.bodyCapture.captures(r.status) {
+		r.bodyCaptured = true
+		limit := r.bodyCapture.rawLimit(r.Header().Get("Content-Encoding"))
+		r.body, r.bodyTruncated = appendCapped(r.body, b[:n], limit, r.bodyTruncated)
+	}
+
+	return n, err
+}
+
+// Flush implements http.Flusher.
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if !r.wroteHeader {
+			r.wroteHeader = true
+			r.markFirstByte()
+		}
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the wrapped ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.markFirstByte()
+	// The handler now owns the connection, typically to switch protocols after a WebSocket upgrade.
+	if !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.wroteHeader = true
+	}
+	return conn, rw, nil
+}
+
+// Push implements http.Pusher.
+func (r *responseRecorder) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := r.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the wrapped writer, for use by http.ResponseController.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// timeToFirstByte returns the time between the start of the request and the first
+// byte of the response, or zero if nothing has been written yet.
+func (r *responseRecorder) timeToFirstByte() time.Duration {
+	if r.firstByte.IsZero() {
+		return 0
+	}
+	return r.firstByte.Sub(r.start)
+}
+
+func (r *responseRecorder) markFirstByte() {
+	if r.firstByte.IsZero() {
+		r.firstByte = time.Now()
+	}
+}
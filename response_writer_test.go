@@ -0,0 +1,73 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hijackableRecorder is a ResponseRecorder whose connection can be hijacked.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	err error
+}
+
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h.err != nil {
+		return nil, nil, h.err
+	}
+	server, client := net.Pipe()
+	_ = client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestResponseRecorderHijack(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		write    func(r *responseRecorder)
+		err      error
+		expected int
+	}{
+		{
+			desc:     "upgrade",
+			expected: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:     "status written before the hijack",
+			write:    func(r *responseRecorder) { r.WriteHeader(http.StatusBadRequest) },
+			expected: http.StatusBadRequest,
+		},
+		{
+			desc:     "failed hijack",
+			err:      errors.New("hijack failed"),
+			expected: http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			r := newResponseRecorder(&hijackableRecorder{ResponseRecorder: httptest.NewRecorder(), err: test.err}, time.Now(), nil)
+			if test.write != nil {
+				test.write(r)
+			}
+
+			conn, _, err := r.Hijack()
+			if (err != nil) != (test.err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if r.status != test.expected {
+				t.Errorf("expected status %d, got %d", test.expected, r.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = "100ms"
+	defaultRetryMaxBackoff     = "30s"
+
+	// maxRetryAfter bounds the delays requested by Elasticsearch with the Retry-After header.
+	maxRetryAfter = 10 * time.Minute
+)
+
+// failureClass is the kind of failure a delivery attempt ended with, which decides whether and how
+// many times a document is retried.
+type failureClass int
+
+const (
+	// failureConnection is a failure to reach Elasticsearch or to read its response.
+	failureConnection failureClass = iota
+	// failureTooManyRequests is a 429 Too Many Requests status.
+	failureTooManyRequests
+	// failureServerError is a 5xx status.
+	failureServerError
+	// failureClientError is any other status, such as a mapping error. It is never retried.
+	failureClientError
+)
+
+func (c failureClass) String() string {
+	switch c {
+	case failureConnection:
+		return "connection error"
+	case failureTooManyRequests:
+		return "too many requests"
+	case failureServerError:
+		return "server error"
+	default:
+		return "client error"
+	}
+}
+
+// classifyStatus returns the failure class of an error status.
+func classifyStatus(status int) failureClass {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return failureTooManyRequests
+	case status >= http.StatusInternalServerError:
+		return failureServerError
+	default:
+		return failureClientError
+	}
+}
+
+// retryPolicy decides how many times, and after which delay, documents are sent again after a failure.
+type retryPolicy struct {
+	// attempts is the number of times a document is sent before it is given up on, per failure class.
+	attempts       map[failureClass]int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryPolicy(config *Config) (retryPolicy, error) {
+	p := retryPolicy{attempts: make(map[failureClass]int)}
+
+	for class, attempts := range map[failureClass]int{
+		failureConnection:      config.RetryConnectionAttempts,
+		failureTooManyRequests: config.RetryTooManyRequestsAttempts,
+		failureServerError:     config.RetryServerErrorAttempts,
+	} {
+		if attempts < 0 {
+			return p, fmt.Errorf("invalid number of attempts after a %s: %d", class, attempts)
+		}
+		if attempts == 0 {
+			attempts = defaultRetryAttempts
+		}
+		p.attempts[class] = attempts
+	}
+	p.attempts[failureClientError] = 1
+
+	var err error
+	if p.initialBackoff, err = parseDuration(config.RetryInitialBackoff, defaultRetryInitialBackoff); err != nil {
+		return p, fmt.Errorf("invalid initial retry backoff: %w", err)
+	}
+	if p.maxBackoff, err = parseDuration(config.RetryMaxBackoff, defaultRetryMaxBackoff); err != nil {
+		return p, fmt.Errorf("invalid maximum retry backoff: %w", err)
+	}
+	if p.maxBackoff < p.initialBackoff {
+		return p, fmt.Errorf("maximum retry backoff %s is shorter than the initial one %s", p.maxBackoff, p.initialBackoff)
+	}
+
+	return p, nil
+}
+
+// retries reports whether a document that failed with class after attempts attempts is sent again.
+func (p retryPolicy) retries(class failureClass, attempts int) bool {
+	return attempts < p.attempts[class]
+}
+
+// backoff returns the delay before the next attempt of a document that failed attempts times. It grows
+// exponentially up to maxBackoff, with a random jitter of up to half of it. A Retry-After delay
+// requested by Elasticsearch takes precedence when longer.
+func (p retryPolicy) backoff(attempts int, retryAfter time.Duration) time.Duration {
+	delay := p.initialBackoff
+	for i := 1; i < attempts && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	if half := int64(delay / 2); half > 0 {
+		//nolint:gosec // The jitter does not need a secure source of randomness.
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	if retryAfter > delay {
+		return retryAfter
+	}
+	return delay
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = date.Sub(now)
+	}
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,114 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyStatus(t *testing.T) {
+	testCases := []struct {
+		status   int
+		expected failureClass
+	}{
+		{status: http.StatusTooManyRequests, expected: failureTooManyRequests},
+		{status: http.StatusInternalServerError, expected: failureServerError},
+		{status: http.StatusServiceUnavailable, expected: failureServerError},
+		{status: http.StatusBadRequest, expected: failureClientError},
+		{status: http.StatusConflict, expected: failureClientError},
+	}
+
+	for _, test := range testCases {
+		if got := classifyStatus(test.status); got != test.expected {
+			t.Errorf("expected status %d to be a %s, got %s", test.status, test.expected, got)
+		}
+	}
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	p, err := newRetryPolicy(&Config{RetryConnectionAttempts: 5, RetryServerErrorAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc     string
+		class    failureClass
+		attempts int
+		expected bool
+	}{
+		{desc: "configured attempts left", class: failureConnection, attempts: 4, expected: true},
+		{desc: "configured attempts exhausted", class: failureConnection, attempts: 5},
+		{desc: "default attempts left", class: failureTooManyRequests, attempts: defaultRetryAttempts - 1, expected: true},
+		{desc: "default attempts exhausted", class: failureTooManyRequests, attempts: defaultRetryAttempts},
+		{desc: "single attempt", class: failureServerError, attempts: 1},
+		{desc: "client error", class: failureClientError, attempts: 1},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := p.retries(test.class, test.attempts); got != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p, err := newRetryPolicy(&Config{RetryInitialBackoff: "100ms", RetryMaxBackoff: "1s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc       string
+		attempts   int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{desc: "first retry", attempts: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{desc: "exponential growth", attempts: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{desc: "maximum backoff", attempts: 10, min: 500 * time.Millisecond, max: time.Second},
+		{desc: "longer Retry-After", attempts: 1, retryAfter: 5 * time.Second, min: 5 * time.Second, max: 5 * time.Second},
+		{desc: "shorter Retry-After", attempts: 10, retryAfter: time.Millisecond, min: 500 * time.Millisecond, max: time.Second},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := p.backoff(test.attempts, test.retryAfter); got < test.min || got > test.max {
+					t.Fatalf("expected a backoff between %s and %s, got %s", test.min, test.max, got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		desc     string
+		value    string
+		expected time.Duration
+	}{
+		{desc: "missing"},
+		{desc: "seconds", value: " 3 ", expected: 3 * time.Second},
+		{desc: "HTTP date", value: "Mon, 01 Jan 2024 12:00:30 GMT", expected: 30 * time.Second},
+		{desc: "past date", value: "Mon, 01 Jan 2024 11:00:00 GMT"},
+		{desc: "negative seconds", value: "-1"},
+		{desc: "capped", value: "86400", expected: maxRetryAfter},
+		{desc: "invalid", value: "soon"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := parseRetryAfter(test.value, now); got != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
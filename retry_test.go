@@ -0,0 +1,235 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestRetryHonorsRetryAfter(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Fail("1", http.StatusTooManyRequests)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+	waitFor(t, func() bool { return len(es.Refreshes()) == 1 })
+	failed := time.Now()
+
+	if docs := es.WaitForDocuments(t, 1); len(docs) != 1 {
+		t.Fatalf("expected 1 indexed document, got %d", len(docs))
+	}
+	if elapsed := time.Since(failed); elapsed < 900*time.Millisecond {
+		t.Errorf("expected the retry to wait for Retry-After, got %s", elapsed)
+	}
+}
+
+func TestRetryIsSentOnceItsBackoffElapses(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Fail("", http.StatusServiceUnavailable)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 1
+	cfg.FlushInterval = "1h"
+	cfg.RetryInitialBackoff = "10ms"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+
+	if docs := es.WaitForDocuments(t, 1); len(docs) != 1 {
+		t.Fatalf("expected the retry to be sent before the next flush interval, got %d documents", len(docs))
+	}
+}
+
+func TestRetryDeadLetterFile(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		fail     func(es *fakeElasticsearch)
+		attempts int
+		errType  string
+		status   int
+	}{
+		{
+			desc:     "mapping error",
+			fail:     func(es *fakeElasticsearch) { es.Reject(http.StatusBadRequest) },
+			attempts: 1,
+			errType:  "client error",
+			status:   http.StatusBadRequest,
+		},
+		{
+			desc:     "server errors",
+			fail:     func(es *fakeElasticsearch) { es.Reject(http.StatusServiceUnavailable, http.StatusBadGateway) },
+			attempts: 2,
+			errType:  "server error",
+			status:   http.StatusBadGateway,
+		},
+		{
+			desc: "failed requests",
+			fail: func(es *fakeElasticsearch) {
+				es.Fail("", http.StatusInternalServerError, http.StatusInternalServerError)
+			},
+			attempts: 2,
+			errType:  "server error",
+			status:   http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+			test.fail(es)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.RetryServerErrorAttempts = 2
+			cfg.RetryInitialBackoff = "1ms"
+			cfg.DeadLetterFile = filepath.Join(t.TempDir(), "dead-letters.ndjson")
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+			elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+			waitFor(t, func() bool { return elasticsearchLog.Metrics().DeadLettered == 1 })
+
+			letters := readDeadLetters(t, cfg.DeadLetterFile)
+			if len(letters) != 1 {
+				t.Fatalf("expected 1 dead letter, got %d", len(letters))
+			}
+			letter := letters[0]
+
+			if got := letter["attempts"]; got != float64(test.attempts) {
+				t.Errorf("expected %d attempts, got %v", test.attempts, got)
+			}
+			if got := lookup(letter, "error.type"); got != test.errType {
+				t.Errorf("expected error type %q, got %v", test.errType, got)
+			}
+			if got := lookup(letter, "error.status"); got != float64(test.status) {
+				t.Errorf("expected error status %d, got %v", test.status, got)
+			}
+			if got := lookup(letter, "error.reason"); got == "" || got == nil {
+				t.Error("expected an error reason")
+			}
+			if got := letter["index"]; got != cfg.IndexName {
+				t.Errorf("expected index %s, got %v", cfg.IndexName, got)
+			}
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal([]byte(letter["document"].(string)), &doc); err != nil || doc["path"] != "/foo" {
+				t.Errorf("expected the failed document, got %v (%v)", letter["document"], err)
+			}
+		})
+	}
+}
+
+func TestRetryDeadLetterIndex(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Reject(http.StatusBadRequest)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.DeadLetterIndex = "dead-letters"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(docs))
+	}
+	if got := lookup(docs[0], "error.reason"); got != "rejected: rejected by test" {
+		t.Errorf("expected the rejection reason, got %v", got)
+	}
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().DeadLettered == 1 })
+	if metrics := elasticsearchLog.Metrics(); metrics.Failed != 1 {
+		t.Errorf("expected 1 failed document, got %+v", metrics)
+	}
+}
+
+func TestRetryDeadLetterIndexWhileCircuitOpen(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Fail("", http.StatusInternalServerError)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.DeadLetterIndex = "dead-letters"
+	cfg.RetryServerErrorAttempts = 1
+	cfg.CircuitBreakerFailureRate = 1
+	cfg.CircuitBreakerMinRequests = 1
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 || lookup(docs[0], "error.type") == nil {
+		t.Fatalf("expected 1 dead letter, got %v", docs)
+	}
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().DeadLettered == 1 })
+	if metrics := elasticsearchLog.Metrics(); metrics.CircuitBreakerState != traefik_plugin_elastic.CircuitOpen || metrics.ShortCircuited != 0 {
+		t.Errorf("expected the dead letter to bypass the open circuit breaker, got %+v", metrics)
+	}
+}
+
+func readDeadLetters(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var letters []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("invalid dead letter %q: %v", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
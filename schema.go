@@ -0,0 +1,319 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SchemaLegacy renders documents as the flat Document structure.
+	SchemaLegacy = "legacy"
+	// SchemaECS renders documents following the Elastic Common Schema.
+	SchemaECS = "ecs"
+
+	defaultSchema     = SchemaLegacy
+	defaultECSVersion = "8.11.0"
+)
+
+// ecsVersions are the Elastic Common Schema versions documents can conform to.
+var ecsVersions = map[string]bool{
+	"1.12.0": true,
+	"8.0.0":  true,
+	"8.1.0":  true,
+	"8.2.0":  true,
+	"8.3.0":  true,
+	"8.4.0":  true,
+	"8.5.0":  true,
+	"8.6.0":  true,
+	"8.7.0":  true,
+	"8.8.0":  true,
+	"8.9.0":  true,
+	"8.10.0": true,
+	"8.11.0": true,
+}
+
+// encoder renders a Document as the JSON source indexed into Elasticsearch.
+type encoder interface {
+	encode(doc *Document) ([]byte, error)
+}
+
+// newEncoder returns the encoder of the given output schema.
+func newEncoder(schema, ecsVersion string) (encoder, error) {
+	switch schema {
+	case "", SchemaLegacy:
+		return legacyEncoder{}, nil
+	case SchemaECS:
+		if ecsVersion == "" {
+			ecsVersion = defaultECSVersion
+		}
+		if !ecsVersions[ecsVersion] {
+			return nil, fmt.Errorf("unsupported ECS version %q", ecsVersion)
+		}
+		return ecsEncoder{version: ecsVersion}, nil
+	default:
+		return nil, fmt.Errorf("unknown output schema %q: expected %s or %s", schema, SchemaLegacy, SchemaECS)
+	}
+}
+
+type legacyEncoder struct{}
+
+func (legacyEncoder) encode(doc *Document) ([]byte, error) {
+	return doc.JSON()
+}
+
+type ecsEncoder struct {
+	version string
+}
+
+// ecsDocument is the subset of the Elastic Common Schema populated by the middleware.
+type ecsDocument struct {
+	Timestamp   time.Time          `json:"@timestamp"`
+	Message     string             `json:"message,omitempty"`
+	ECS         ecsMeta            `json:"ecs"`
+	Event       ecsEvent           `json:"event"`
+	HTTP        ecsHTTP            `json:"http"`
+	URL         ecsURL             `json:"url"`
+	Source      ecsEndpoint        `json:"source"`
+	Client      ecsEndpoint        `json:"client"`
+	UserAgent   *ecsUserAgent      `json:"user_agent,omitempty"`
+	User        *User              `json:"user,omitempty"`
+	GraphQL     []GraphQLOperation `json:"graphql,omitempty"`
+	Trace       *Identifier        `json:"trace,omitempty"`
+	Parent      *Identifier        `json:"parent,omitempty"`
+	Transaction *Identifier        `json:"transaction,omitempty"`
+	Span        *Identifier        `json:"span,omitempty"`
+	Related     *ecsRelated        `json:"related,omitempty"`
+	Tags        []string           `json:"tags,omitempty"`
+}
+
+type ecsMeta struct {
+	Version string `json:"version"`
+}
+
+type ecsEvent struct {
+	Kind     string        `json:"kind"`
+	Category []string      `json:"category"`
+	Type     []string      `json:"type"`
+	Outcome  string        `json:"outcome"`
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+}
+
+type ecsHTTP struct {
+	Version  string          `json:"version,omitempty"`
+	Request  ecsHTTPRequest  `json:"request"`
+	Response ecsHTTPResponse `json:"response"`
+}
+
+type ecsHTTPRequest struct {
+	ID       string            `json:"id,omitempty"`
+	Method   string            `json:"method"`
+	Referrer string            `json:"referrer,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     *ecsHTTPBody      `json:"body,omitempty"`
+}
+
+type ecsHTTPResponse struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       *ecsHTTPBody      `json:"body,omitempty"`
+}
+
+type ecsHTTPBody struct {
+	Bytes     *int64 `json:"bytes,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated *bool  `json:"truncated,omitempty"`
+}
+
+type ecsURL struct {
+	Original string `json:"original"`
+	Scheme   string `json:"scheme,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Query    string `json:"query,omitempty"`
+}
+
+type ecsEndpoint struct {
+	Address string `json:"address,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	Geo     *Geo   `json:"geo,omitempty"`
+	AS      *AS    `json:"as,omitempty"`
+}
+
+type ecsRelated struct {
+	IP []string `json:"ip,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string           `json:"original"`
+	Name     string           `json:"name,omitempty"`
+	Version  string           `json:"version,omitempty"`
+	OS       *UserAgentOS     `json:"os,omitempty"`
+	Device   *UserAgentDevice `json:"device,omitempty"`
+}
+
+func (e ecsEncoder) encode(doc *Document) ([]byte, error) {
+	out := ecsDocument{
+		Timestamp: doc.Timestamp,
+		Message:   doc.Message,
+		ECS:       ecsMeta{Version: e.version},
+		Event: ecsEvent{
+			Kind:     "event",
+			Category: []string{"web"},
+			Type:     []string{"access"},
+			Outcome:  ecsOutcome(doc.Status),
+			Start:    doc.Timestamp,
+			End:      doc.Timestamp.Add(doc.Duration),
+			Duration: doc.Duration,
+		},
+		HTTP: ecsHTTP{
+			Version: strings.TrimPrefix(doc.Protocol, "HTTP/"),
+			Request: ecsHTTPRequest{
+				ID:       doc.RequestID,
+				Method:   doc.Method,
+				Referrer: doc.Referer,
+				Headers:  doc.RequestHeaders,
+			},
+			Response: ecsHTTPResponse{
+				StatusCode: doc.Status,
+				Headers:    doc.ResponseHeaders,
+				Body:       ecsBody(doc.BytesSent, doc.ResponseBody),
+			},
+		},
+		URL:         ecsURLFromDocument(doc),
+		Source:      ecsEndpointFromAddr(doc.RemoteAddr),
+		Client:      ecsEndpointFromAddr(doc.RemoteAddr),
+		User:        doc.User,
+		GraphQL:     doc.GraphQL,
+		Trace:       doc.Trace,
+		Parent:      doc.Parent,
+		Transaction: doc.Transaction,
+		Span:        doc.Span,
+	}
+	if doc.ClientIP != "" && doc.ClientIP != out.Source.IP {
+		out.Source = ecsEndpoint{Address: doc.ClientIP, IP: doc.ClientIP}
+		out.Client = out.Source
+	}
+	out.Source.Geo, out.Source.AS = doc.Geo, doc.AS
+	out.Client.Geo, out.Client.AS = doc.Geo, doc.AS
+	if len(doc.ForwardedFor) > 0 {
+		out.Related = &ecsRelated{IP: relatedIPs(doc)}
+	}
+	out.HTTP.Request.Body = ecsBody(doc.ContentLength, doc.RequestBody)
+	if doc.UserAgent != "" {
+		out.UserAgent = &ecsUserAgent{Original: doc.UserAgent}
+	}
+	if ua := doc.UserAgentDetails; ua != nil && out.UserAgent != nil {
+		out.UserAgent.Name = ua.Name
+		out.UserAgent.Version = ua.Version
+		out.UserAgent.OS = ua.OS
+		out.UserAgent.Device = ua.Device
+		if ua.Bot {
+			out.Tags = append(out.Tags, "bot")
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+// ecsBody describes a message body of size bytes, -1 if unknown, and its captured content if any.
+func ecsBody(bytes int64, captured *Body) *ecsHTTPBody {
+	if bytes < 0 && captured == nil {
+		return nil
+	}
+
+	body := &ecsHTTPBody{}
+	if bytes >= 0 {
+		body.Bytes = &bytes
+	}
+	if captured != nil {
+		body.Content = captured.Content
+		body.Encoding = captured.Encoding
+		body.Truncated = &captured.Truncated
+	}
+
+	return body
+}
+
+func ecsURLFromDocument(doc *Document) ecsURL {
+	u := ecsURL{
+		Scheme: doc.Scheme,
+		Path:   doc.Path,
+		Query:  doc.Query,
+	}
+
+	u.Domain, u.Port = splitHostPort(doc.Host)
+
+	u.Original = doc.Path
+	if doc.Query != "" {
+		u.Original += "?" + doc.Query
+	}
+
+	return u
+}
+
+func ecsEndpointFromAddr(addr string) ecsEndpoint {
+	host, port := splitHostPort(addr)
+
+	endpoint := ecsEndpoint{Address: host, Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		endpoint.IP = ip.String()
+	}
+
+	return endpoint
+}
+
+// relatedIPs lists the valid addresses of the forwarding chain and of the peer, without duplicates.
+func relatedIPs(doc *Document) []string {
+	peer, _ := splitHostPort(doc.RemoteAddr)
+
+	var ips []string
+	seen := make(map[string]bool)
+	for _, hop := range append(append([]string(nil), doc.ForwardedFor...), peer) {
+		ip := net.ParseIP(hop)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip.String())
+	}
+	return ips
+}
+
+// splitHostPort splits addr into its host and port, returning a zero port when addr has none.
+func splitHostPort(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]"), 0
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+
+	return host, port
+}
+
+// ecsOutcome maps a response status to the ECS event.outcome values.
+func ecsOutcome(status int) string {
+	switch {
+	case status == 0:
+		return "unknown"
+	case status >= 400:
+		return "failure"
+	default:
+		return "success"
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestECSSchema(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		version  string
+		expected map[string]interface{}
+	}{
+		{
+			desc: "default version",
+			expected: map[string]interface{}{
+				"ecs.version":               "8.11.0",
+				"event.category":            []interface{}{"web"},
+				"http.request.method":       http.MethodPost,
+				"http.response.status_code": float64(http.StatusCreated),
+				"http.response.body.bytes":  float64(2),
+				"http.version":              "1.1",
+				"url.domain":                "test.com",
+				"url.port":                  float64(8080),
+				"url.path":                  "/foo",
+				"url.query":                 "bar=baz",
+				"url.original":              "/foo?bar=baz",
+				"source.ip":                 "10.0.0.1",
+				"source.port":               float64(1234),
+				"client.ip":                 "10.0.0.1",
+				"user_agent.original":       "test-agent",
+				"message":                   "Test Elasticsearch",
+				"event.outcome":             "success",
+				"event.kind":                "event",
+				"event.type":                []interface{}{"access"},
+			},
+		},
+		{
+			desc:    "ECS 1.x",
+			version: "1.12.0",
+			expected: map[string]interface{}{
+				"ecs.version":         "1.12.0",
+				"http.request.method": http.MethodPost,
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.Schema = traefik_plugin_elastic.SchemaECS
+			cfg.ECSVersion = test.version
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte("ok"))
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "http://test.com:8080/foo?bar=baz", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("User-Agent", "test-agent")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			for field, value := range test.expected {
+				got := lookup(docs[0], field)
+				if !reflect.DeepEqual(got, value) {
+					t.Errorf("%s: expected %v, got %v", field, value, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+const defaultShutdownTimeout = "5s"
+
+// pipelineRegistry holds the pipelines of the running middleware instances, keyed by the hash of their
+// configuration. Traefik creates new instances on every configuration change, and instances with an
+// identical configuration share one pipeline, and thus one queue, spool and set of connections.
+type pipelineRegistry struct {
+	mu        sync.Mutex
+	pipelines map[string]*sharedPipeline
+}
+
+var sharedPipelines = &pipelineRegistry{pipelines: make(map[string]*sharedPipeline)}
+
+// sharedPipeline is a pipeline with the number of middleware instances using it.
+type sharedPipeline struct {
+	// ready is closed once pipeline, or err, is set.
+	ready    chan struct{}
+	pipeline *pipeline
+	err      error
+	refs     int
+}
+
+// acquire returns the pipeline of the instances configured by config, creating it if there is none.
+// The instance releases its reference when ctx is done, and the pipeline is stopped once no instance
+// uses it anymore. release releases the reference early, when the instance fails to start.
+//
+// The pipeline is created without holding the registry lock, since loading its spool may take a
+// while: instances with the same configuration wait for it, and the others are not delayed.
+func (r *pipelineRegistry) acquire(ctx context.Context, config *Config) (p *pipeline, release func(), err error) {
+	key, err := configKey(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.mu.Lock()
+	shared := r.pipelines[key]
+	if shared == nil {
+		shared = &sharedPipeline{ready: make(chan struct{})}
+		r.pipelines[key] = shared
+		shared.refs++
+		r.mu.Unlock()
+
+		shared.pipeline, shared.err = newConfiguredPipeline(config)
+		if shared.err != nil {
+			r.mu.Lock()
+			delete(r.pipelines, key)
+			r.mu.Unlock()
+		}
+		close(shared.ready)
+	} else {
+		shared.refs++
+		r.mu.Unlock()
+		<-shared.ready
+	}
+	if shared.err != nil {
+		return nil, nil, shared.err
+	}
+
+	var once sync.Once
+	release = func() { once.Do(func() { r.release(key, shared) }) }
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			release()
+		}()
+	}
+
+	return shared.pipeline, release, nil
+}
+
+// release releases a reference to shared, stopping its pipeline if it was the last one.
+func (r *pipelineRegistry) release(key string, shared *sharedPipeline) {
+	r.mu.Lock()
+	shared.refs--
+	last := shared.refs == 0
+	if last {
+		delete(r.pipelines, key)
+	}
+	r.mu.Unlock()
+
+	if last {
+		shared.pipeline.stop()
+	}
+}
+
+// configKey returns the hash identifying the instances configured identically to config.
+func configKey(config *Config) (string, error) {
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("error encoding the configuration: %w", err)
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newConfiguredPipeline creates the pipeline delivering the documents of the instances configured
+// by config, along with its Elasticsearch client, workers and spool.
+func newConfiguredPipeline(config *Config) (*pipeline, error) {
+	flushInterval, err := parseDuration(config.FlushInterval, defaultFlushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flush interval: %w", err)
+	}
+	shutdownTimeout, err := parseDuration(config.ShutdownTimeout, defaultShutdownTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shutdown timeout: %w", err)
+	}
+
+	queueOpts, err := newQueueOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	bulkOpts, err := newBulkOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the Elasticsearch client: %w", err)
+	}
+
+	metrics := &metrics{}
+
+	var transport esapi.Transport = client
+	breaker, err := newCircuitBreaker(config, client, metrics)
+	if err != nil {
+		return nil, err
+	}
+	if breaker != nil {
+		transport = breaker
+	}
+
+	var spool *spool
+	if config.SpoolDirectory != "" {
+		spoolMaxAge, err := parseDuration(config.SpoolMaxAge, defaultSpoolMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool maximum age: %w", err)
+		}
+		spool, err = sharedSpools.open(config.SpoolDirectory, config.SpoolMaxBytes, config.SpoolSegmentBytes, spoolMaxAge, config.SpoolEviction)
+		if err != nil {
+			return nil, err
+		}
+		metrics.spool = spool
+	}
+
+	if bulkOpts.deadLetters, err = newDeadLetterSink(config, client); err != nil {
+		spool.close()
+		return nil, err
+	}
+
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	requests, cancel := context.WithCancel(context.Background())
+	indexers := make([]*bulkIndexer, 0, workers)
+	for i := 0; i < workers; i++ {
+		indexers = append(indexers, newBulkIndexer(requests, transport, bulkOpts, metrics, spool))
+	}
+	p := newPipeline(queueOpts, flushInterval, indexers, metrics, spool)
+	p.deadLetters = bulkOpts.deadLetters
+	p.shutdownTimeout, p.cancel = shutdownTimeout, cancel
+
+	return p, nil
+}
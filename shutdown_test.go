@@ -0,0 +1,128 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestShutdownFlushesQueuedDocuments(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushInterval = "1h"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(ctx, next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/"+strconv.Itoa(i), nil))
+	}
+	cancel()
+
+	docs := es.WaitForDocuments(t, 3)
+	if len(docs) != 3 {
+		t.Fatalf("expected the queued documents to be flushed on shutdown, got %d", len(docs))
+	}
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Indexed == 3 })
+
+	// Requests still served by the instance once it is shut down are not logged.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://test.com/late", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if metrics := elasticsearchLog.Metrics(); metrics.DroppedShutdown != 1 {
+		t.Errorf("expected 1 document dropped after the shutdown, got %+v", metrics)
+	}
+}
+
+func TestShutdownSpoolsDocumentsNotDeliveredInTime(t *testing.T) {
+	es := newStalledElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 1
+	cfg.ShutdownTimeout = "50ms"
+	cfg.SpoolDirectory = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(ctx, next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/0", nil))
+	<-es.requests
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/1", nil))
+	cancel()
+
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Spooled == 2 })
+	if metrics := elasticsearchLog.Metrics(); metrics.Failed != 0 {
+		t.Errorf("expected no failed document, got %+v", metrics)
+	}
+	if segments := spoolSegments(t, cfg.SpoolDirectory); segments == 0 {
+		t.Error("expected the documents to be left in the spool")
+	}
+}
+
+func TestInstancesShareIdenticalPipelines(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushDocuments = 1
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	oldCtx, cancelOld := context.WithCancel(context.Background())
+	defer cancelOld()
+	old, err := traefik_plugin_elastic.New(oldCtx, next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	// Traefik creates the new instance before shutting down the old one.
+	newCtx, cancelNew := context.WithCancel(context.Background())
+	defer cancelNew()
+	current, err := traefik_plugin_elastic.New(newCtx, next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := current.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	old.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/old", nil))
+	cancelOld()
+	current.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/new", nil))
+
+	es.WaitForDocuments(t, 2)
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Indexed == 2 })
+
+	// Once the last instance is shut down, the pipeline stops.
+	cancelNew()
+	waitFor(t, func() bool {
+		current.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/late", nil))
+		return elasticsearchLog.Metrics().DroppedShutdown > 0
+	})
+}
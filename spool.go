@@ -0,0 +1,544 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSpoolMaxBytes     = 256 << 20
+	defaultSpoolSegmentBytes = 4 << 20
+	defaultSpoolMaxAge       = "24h"
+	defaultSpoolEviction     = PolicyDropOldest
+
+	// spoolProbeInterval is how often spooled documents are sent while Elasticsearch is failing,
+	// to find out whether it is back.
+	spoolProbeInterval = 30 * time.Second
+
+	spoolSegmentExt = ".spool"
+	// spoolMagic starts every segment file.
+	spoolMagic = "TPESPL1\n"
+	// spoolRecordHeaderSize is the size of the length and CRC-32C checksum preceding each record.
+	spoolRecordHeaderSize = 8
+)
+
+var spoolCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spool is a disk-backed queue of encoded documents that could not be delivered to Elasticsearch.
+// Documents are appended to segment files in a directory and read back one segment at a time,
+// oldest first; a segment is deleted once each of its documents has been indexed, spooled anew or
+// given up on. Segments left by a previous process are replayed.
+//
+// Each segment starts with spoolMagic and holds records made of the big-endian length of the
+// payload, its CRC-32C checksum and the payload: the big-endian length of the document ID, the
+// ID and the encoded document. Reading a segment stops at the first truncated or corrupted record.
+type spool struct {
+	// spooled, dropped and bytes are the spool counters reported in the metrics of the pipelines using
+	// the spool. They are accessed atomically.
+	spooled int64
+	dropped int64
+	bytes   int64
+
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	maxAge       time.Duration
+	eviction     string
+	// refs is the number of pipelines using the spool, guarded by the mutex of sharedSpools.
+	refs int
+
+	mu       sync.Mutex
+	segments []*spoolSegment
+	active   *os.File
+	size     int64
+	seq      int
+	// lastProbe is when spooled documents were last read while Elasticsearch was failing.
+	lastProbe time.Time
+}
+
+// spoolSegment is a segment file. The last segment is the one being written to while active is set.
+type spoolSegment struct {
+	path    string
+	size    int64
+	records int
+	modTime time.Time
+	// pending is the number of documents read from the segment that are still being delivered.
+	pending int
+}
+
+// spoolRegistry holds the spools in use, keyed by their absolute directory. Pipelines spooling to the
+// same directory, such as those of the old and new configurations while Traefik reloads, share one
+// spool, so that they never deliver nor delete the segments of each other.
+type spoolRegistry struct {
+	mu     sync.Mutex
+	spools map[string]*spool
+}
+
+var sharedSpools = &spoolRegistry{spools: make(map[string]*spool)}
+
+// open returns the spool of dir, creating it if no pipeline uses it yet. A shared spool keeps the
+// settings of the pipeline that created it. The spool must be released with close.
+func (r *spoolRegistry) open(dir string, maxBytes, segmentBytes int64, maxAge time.Duration, eviction string) (*spool, error) {
+	if _, _, _, err := spoolLimits(maxBytes, segmentBytes, eviction); err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spool directory: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.spools[dir]
+	if s == nil {
+		if s, err = newSpool(dir, maxBytes, segmentBytes, maxAge, eviction); err != nil {
+			return nil, err
+		}
+		r.spools[dir] = s
+	}
+	s.refs++
+	return s, nil
+}
+
+// release releases a reference to s, and reports whether it was the last one. Spools not opened
+// through the registry have no other reference.
+func (r *spoolRegistry) release(s *spool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.spools[s.dir] != s {
+		return true
+	}
+	if s.refs--; s.refs > 0 {
+		return false
+	}
+	delete(r.spools, s.dir)
+	return true
+}
+
+// spoolLimits validates the size limits and eviction policy of a spool, and returns them with their
+// defaults applied.
+func spoolLimits(maxBytes, segmentBytes int64, eviction string) (int64, int64, string, error) {
+	if maxBytes < 0 || segmentBytes < 0 {
+		return 0, 0, "", errors.New("invalid spool size")
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if segmentBytes == 0 {
+		segmentBytes = defaultSpoolSegmentBytes
+	}
+	if segmentBytes > maxBytes {
+		segmentBytes = maxBytes
+	}
+	if eviction == "" {
+		eviction = defaultSpoolEviction
+	}
+	if eviction != PolicyDropOldest && eviction != PolicyDropNewest {
+		return 0, 0, "", fmt.Errorf("unknown spool eviction policy %q: expected drop-oldest or drop-newest", eviction)
+	}
+	return maxBytes, segmentBytes, eviction, nil
+}
+
+func newSpool(dir string, maxBytes, segmentBytes int64, maxAge time.Duration, eviction string) (*spool, error) {
+	maxBytes, segmentBytes, eviction, err := spoolLimits(maxBytes, segmentBytes, eviction)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating the spool directory: %w", err)
+	}
+
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		maxAge:       maxAge,
+		eviction:     eviction,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load indexes the segments left in the spool directory by a previous process.
+func (s *spool) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("error reading the spool: %w", err)
+		}
+		items, err := readSpoolSegment(path)
+		if err != nil {
+			log.Printf("Skipping corrupted spool segment %s: %s", path, err)
+		}
+		if len(items) == 0 {
+			_ = os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{
+			path:    path,
+			size:    info.Size(),
+			records: len(items),
+			modTime: info.ModTime(),
+		})
+		s.size += info.Size()
+	}
+
+	if n := s.records(); n > 0 {
+		log.Printf("Replaying %d spooled documents from %s", n, s.dir)
+	}
+	atomic.AddInt64(&s.bytes, s.size)
+	return nil
+}
+
+// append writes items to the spool. When they do not fit, the oldest spooled documents are evicted,
+// or the newest items are dropped, as the eviction policy requires.
+func (s *spool) append(items []*bulkItem) {
+	if len(items) == 0 {
+		return
+	}
+
+	records := make([][]byte, len(items))
+	for i, item := range items {
+		records[i] = encodeSpoolRecord(item)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Documents are spooled after failed deliveries: wait before probing Elasticsearch with them.
+	s.lastProbe = time.Now()
+	s.expire(s.lastProbe)
+
+	room := s.maxBytes - int64(len(spoolMagic))
+	if s.eviction == PolicyDropNewest {
+		room -= s.size
+	}
+	first, last, size := 0, len(records), int64(0)
+	for _, record := range records {
+		size += int64(len(record))
+	}
+	for size > room && first < last {
+		// Drop the oldest items first, unless the newest must be dropped.
+		if s.eviction == PolicyDropNewest {
+			last--
+			size -= int64(len(records[last]))
+		} else {
+			size -= int64(len(records[first]))
+			first++
+		}
+	}
+	if dropped := len(records) - (last - first); dropped > 0 {
+		s.drop(dropped, "the spool is full")
+	}
+	if first == last {
+		return
+	}
+	s.makeRoom(size)
+
+	written, err := s.write(records[first:last])
+	atomic.AddInt64(&s.spooled, int64(written))
+	if err != nil {
+		log.Printf("Error writing to the spool: %s", err)
+		s.closeActive()
+		s.drop(last-first-written, "the spool cannot be written")
+	}
+}
+
+// makeRoom evicts the oldest segments until n more bytes fit in the spool.
+func (s *spool) makeRoom(n int64) {
+	for len(s.segments) > 0 && s.size+n+int64(len(spoolMagic)) > s.maxBytes {
+		if len(s.segments) == 1 {
+			s.closeActive()
+		}
+		s.evict(s.segments[0], "the spool is full")
+	}
+}
+
+// write appends records to the active segment, starting a new segment whenever the next record does
+// not fit in it, so that segments only exceed segmentBytes when they hold a single larger record.
+// It returns the number of records written.
+func (s *spool) write(records [][]byte) (int, error) {
+	written := 0
+	for written < len(records) {
+		if s.active != nil {
+			if last := s.segments[len(s.segments)-1]; last.records > 0 && last.size+int64(len(records[written])) > s.segmentBytes {
+				s.closeActive()
+			}
+		}
+		if s.active == nil {
+			if err := s.create(); err != nil {
+				return written, err
+			}
+		}
+
+		segment := s.segments[len(s.segments)-1]
+		count, size := 1, segment.size+int64(len(records[written]))
+		for written+count < len(records) && size+int64(len(records[written+count])) <= s.segmentBytes {
+			size += int64(len(records[written+count]))
+			count++
+		}
+
+		n, err := s.active.Write(bytes.Join(records[written:written+count], nil))
+		// Account for partial writes: the size cap must hold even if the segment ends with a broken record.
+		segment.size += int64(n)
+		s.grow(int64(n))
+		if err != nil {
+			return written, err
+		}
+		if err := s.active.Sync(); err != nil {
+			return written, err
+		}
+		segment.records += count
+		segment.modTime = time.Now()
+		written += count
+	}
+	return written, nil
+}
+
+// create starts a new active segment.
+func (s *spool) create() error {
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.seq, spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(spoolMagic); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, &spoolSegment{path: path, size: int64(len(spoolMagic))})
+	s.grow(int64(len(spoolMagic)))
+	return nil
+}
+
+// next removes the oldest segment from the spool and returns its documents. The segment file is kept
+// until release has been called for each of them, so that they are replayed if the process stops before.
+// It returns nil when the spool is empty.
+func (s *spool) next() []*bulkItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+		if len(s.segments) == 1 {
+			s.closeActive()
+		}
+		s.segments = s.segments[1:]
+		s.grow(-segment.size)
+
+		items, err := readSpoolSegment(segment.path)
+		if err != nil {
+			log.Printf("Skipping corrupted spool segment %s after %d documents: %s", segment.path, len(items), err)
+			if lost := segment.records - len(items); lost > 0 {
+				s.drop(lost, "the spool segment is corrupted")
+			}
+		}
+		if len(items) == 0 {
+			_ = os.Remove(segment.path)
+			continue
+		}
+		segment.pending = len(items)
+		for _, item := range items {
+			item.segment = segment
+		}
+		return items
+	}
+	return nil
+}
+
+// release records that items are indexed, spooled anew or given up on, deleting the segments they
+// were read from once none of their documents is pending anymore. Items not read from the spool are
+// ignored.
+func (s *spool) release(items []*bulkItem) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		segment := item.segment
+		if segment == nil {
+			continue
+		}
+		item.segment = nil
+		if segment.pending--; segment.pending > 0 {
+			continue
+		}
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing the spool segment %s: %s", segment.path, err)
+		}
+	}
+}
+
+// ready reports whether spooled documents should be read: the spool is not empty and Elasticsearch
+// is not failing, or it is failing and was not probed for spoolProbeInterval.
+func (s *spool) ready(failing bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 {
+		return false
+	}
+	if !failing {
+		return true
+	}
+	if time.Since(s.lastProbe) < spoolProbeInterval {
+		return false
+	}
+	s.lastProbe = time.Now()
+	return true
+}
+
+// close releases the spool, closing its active segment once no pipeline uses it anymore. Spooled
+// documents are replayed by the next process.
+func (s *spool) close() {
+	if s == nil || !sharedSpools.release(s) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeActive()
+}
+
+// expire evicts the segments whose last document is older than maxAge.
+func (s *spool) expire(now time.Time) {
+	if s.maxAge <= 0 {
+		return
+	}
+	for len(s.segments) > 0 && now.Sub(s.segments[0].modTime) > s.maxAge {
+		if len(s.segments) == 1 {
+			s.closeActive()
+		}
+		s.evict(s.segments[0], "the spooled documents are too old")
+	}
+}
+
+// evict deletes the first segment, which must not be the active one, without delivering its documents.
+func (s *spool) evict(segment *spoolSegment, reason string) {
+	s.segments = s.segments[1:]
+	s.grow(-segment.size)
+	if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing the spool segment %s: %s", segment.path, err)
+	}
+	s.drop(segment.records, reason)
+}
+
+func (s *spool) closeActive() {
+	if s.active == nil {
+		return
+	}
+	if err := s.active.Close(); err != nil {
+		log.Printf("Error closing the spool segment: %s", err)
+	}
+	s.active = nil
+}
+
+// counters returns the number of documents spooled and dropped, and the size of the spool.
+func (s *spool) counters() (spooled, dropped, size int64) {
+	if s == nil {
+		return 0, 0, 0
+	}
+	return atomic.LoadInt64(&s.spooled), atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.bytes)
+}
+
+func (s *spool) grow(n int64) {
+	s.size += n
+	atomic.AddInt64(&s.bytes, n)
+}
+
+// drop counts n documents lost by the spool.
+func (s *spool) drop(n int, reason string) {
+	dropped := atomic.AddInt64(&s.dropped, int64(n))
+	log.Printf("Dropping %d spooled documents: %s (%d dropped so far)", n, reason, dropped)
+}
+
+func (s *spool) records() int {
+	n := 0
+	for _, segment := range s.segments {
+		n += segment.records
+	}
+	return n
+}
+
+func encodeSpoolRecord(item *bulkItem) []byte {
+	record := make([]byte, spoolRecordHeaderSize+2, spoolRecordHeaderSize+2+len(item.id)+len(item.body))
+	binary.BigEndian.PutUint16(record[spoolRecordHeaderSize:], uint16(len(item.id)))
+	record = append(record, item.id...)
+	record = append(record, item.body...)
+
+	payload := record[spoolRecordHeaderSize:]
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, spoolCRCTable))
+	return record
+}
+
+// readSpoolSegment reads the documents of a segment file. When the segment is truncated or corrupted,
+// it returns the documents preceding the first invalid record with an error.
+func readSpoolSegment(path string) ([]*bulkItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(spoolMagic)) {
+		return nil, errors.New("not a spool segment")
+	}
+	data = data[len(spoolMagic):]
+
+	var items []*bulkItem
+	for len(data) > 0 {
+		if len(data) < spoolRecordHeaderSize {
+			return items, io.ErrUnexpectedEOF
+		}
+		length := binary.BigEndian.Uint32(data[:4])
+		checksum := binary.BigEndian.Uint32(data[4:8])
+		if uint64(length) > uint64(len(data)-spoolRecordHeaderSize) {
+			return items, io.ErrUnexpectedEOF
+		}
+		payload := data[spoolRecordHeaderSize : spoolRecordHeaderSize+int(length)]
+		if crc32.Checksum(payload, spoolCRCTable) != checksum {
+			return items, errors.New("checksum mismatch")
+		}
+		if len(payload) < 2 || int(binary.BigEndian.Uint16(payload))+2 > len(payload) {
+			return items, errors.New("invalid record")
+		}
+		idLength := int(binary.BigEndian.Uint16(payload))
+		items = append(items, &bulkItem{
+			id:   string(payload[2 : 2+idLength]),
+			body: append([]byte(nil), payload[2+idLength:]...),
+		})
+		data = data[spoolRecordHeaderSize+int(length):]
+	}
+	return items, nil
+}
@@ -0,0 +1,146 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadSpoolSegment(t *testing.T) {
+	first := encodeSpoolRecord(&bulkItem{id: "1", body: []byte(`{"path":"/1"}`)})
+	second := encodeSpoolRecord(&bulkItem{body: []byte(`{"path":"/2"}`)})
+	corrupted := append([]byte(nil), second...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	testCases := []struct {
+		desc     string
+		data     []byte
+		expected []string
+		wantErr  bool
+	}{
+		{
+			desc:     "records",
+			data:     bytes.Join([][]byte{[]byte(spoolMagic), first, second}, nil),
+			expected: []string{`1 {"path":"/1"}`, ` {"path":"/2"}`},
+		},
+		{
+			desc: "empty segment",
+			data: []byte(spoolMagic),
+		},
+		{
+			desc:    "missing magic",
+			data:    first,
+			wantErr: true,
+		},
+		{
+			desc:     "truncated header",
+			data:     bytes.Join([][]byte{[]byte(spoolMagic), first, second[:4]}, nil),
+			expected: []string{`1 {"path":"/1"}`},
+			wantErr:  true,
+		},
+		{
+			desc:     "truncated payload",
+			data:     bytes.Join([][]byte{[]byte(spoolMagic), first, second[:len(second)-1]}, nil),
+			expected: []string{`1 {"path":"/1"}`},
+			wantErr:  true,
+		},
+		{
+			desc:     "checksum mismatch",
+			data:     bytes.Join([][]byte{[]byte(spoolMagic), first, corrupted, second}, nil),
+			expected: []string{`1 {"path":"/1"}`},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "segment"+spoolSegmentExt)
+			if err := os.WriteFile(path, test.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			items, err := readSpoolSegment(path)
+			if (err != nil) != test.wantErr {
+				t.Errorf("expected an error: %t, got %v", test.wantErr, err)
+			}
+			var got []string
+			for _, item := range items {
+				got = append(got, item.id+" "+string(item.body))
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestSpoolSplitsBatchesAcrossSegments(t *testing.T) {
+	items := make([]*bulkItem, 10)
+	for i := range items {
+		items[i] = &bulkItem{id: strconv.Itoa(i), body: bytes.Repeat([]byte("x"), 100)}
+	}
+	recordSize := int64(len(encodeSpoolRecord(items[0])))
+	segmentBytes := int64(len(spoolMagic)) + 3*recordSize
+
+	s, err := newSpool(t.TempDir(), 1<<20, segmentBytes, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.append(items)
+	s.close()
+
+	if len(s.segments) != 4 {
+		t.Fatalf("expected 4 segments, got %d", len(s.segments))
+	}
+	for i, segment := range s.segments {
+		info, err := os.Stat(segment.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > segmentBytes {
+			t.Errorf("expected segment %d to hold at most %d bytes, got %d", i, segmentBytes, info.Size())
+		}
+	}
+	if spooled, _, _ := s.counters(); spooled != 10 {
+		t.Errorf("expected 10 spooled documents, got %d", spooled)
+	}
+}
+
+func TestSpoolKeepsSegmentsUntilReleased(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 1<<20, 0, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	s.append([]*bulkItem{{id: "1", body: []byte(`{}`)}, {id: "2", body: []byte(`{}`)}})
+	path := s.segments[0].path
+
+	items := s.next()
+	if len(items) != 2 {
+		t.Fatalf("expected 2 spooled documents, got %d", len(items))
+	}
+
+	s.release(items[:1])
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the segment to be kept while a document is pending: %v", err)
+	}
+
+	// Releasing an item twice must not delete the segment early.
+	s.release(items[:1])
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the segment to be kept while a document is pending: %v", err)
+	}
+
+	s.release(items[1:])
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the segment to be deleted, got %v", err)
+	}
+}
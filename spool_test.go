@@ -0,0 +1,226 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestSpoolDeliversAfterFailures(t *testing.T) {
+	es := newFakeElasticsearch(t)
+	es.Reject(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.SpoolDirectory = t.TempDir()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/spooled", nil))
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 || docs[0]["path"] != "/spooled" {
+		t.Fatalf("expected the spooled document to be indexed, got %v", docs)
+	}
+
+	metrics := elasticsearchLog.Metrics()
+	if metrics.Spooled != 1 || metrics.Failed != 0 {
+		t.Errorf("expected 1 spooled and no failed document, got %+v", metrics)
+	}
+	waitFor(t, func() bool { return spoolSegments(t, cfg.SpoolDirectory) == 0 })
+}
+
+func TestSpoolReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = down.URL
+	cfg.FlushDocuments = 3
+	cfg.FlushInterval = "1h"
+	cfg.RetryConnectionAttempts = 1
+	cfg.SpoolDirectory = dir
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler, err := traefik_plugin_elastic.New(ctx, next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/"+strconv.Itoa(i), nil))
+	}
+	waitFor(t, func() bool { return elasticsearchLog.Metrics().Spooled == 3 })
+
+	// Shut the instance down, so that the next one loads the spool as a new process would.
+	cancel()
+	waitFor(t, func() bool { return !traefik_plugin_elastic.SpoolInUse(dir) })
+
+	// Cut the last record short, as a crash in the middle of a write would, and add a segment
+	// that is not a spool segment.
+	segments, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("expected 1 spool segment, got %v (%v)", segments, err)
+	}
+	info, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0], info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000000-000000.spool"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	es := newFakeElasticsearch(t)
+	cfg.ElasticsearchURL = es.URL
+	cfg.FlushInterval = "10ms"
+
+	handler, err = traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	docs := es.WaitForDocuments(t, 2)
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 replayed documents, got %d", len(docs))
+	}
+	for i, doc := range docs {
+		if expected := "/" + strconv.Itoa(i); doc["path"] != expected {
+			t.Errorf("expected the document of %s, got %v", expected, doc["path"])
+		}
+	}
+	waitFor(t, func() bool { return spoolSegments(t, dir) == 0 })
+}
+
+func TestSpoolIsSharedAcrossConfigurations(t *testing.T) {
+	dir := t.TempDir()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	failing := loadConfig()
+	failing.ElasticsearchURL = down.URL
+	failing.FlushDocuments = 1
+	failing.FlushInterval = "1h"
+	failing.RetryConnectionAttempts = 1
+	failing.SpoolDirectory = dir
+
+	es := newFakeElasticsearch(t)
+	working := loadConfig()
+	working.ElasticsearchURL = es.URL
+	working.FlushInterval = "10ms"
+	working.SpoolDirectory = dir
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, failing, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+	other, err := traefik_plugin_elastic.New(testContext(t), next, working, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	// The document spooled by the first configuration is delivered by the second one.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/spooled", nil))
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 || docs[0]["path"] != "/spooled" {
+		t.Fatalf("expected the spooled document to be indexed, got %v", docs)
+	}
+	if metrics := other.(*traefik_plugin_elastic.ElasticsearchLog).Metrics(); metrics.Spooled != 1 {
+		t.Errorf("expected the spool counters to be shared, got %+v", metrics)
+	}
+	waitFor(t, func() bool { return spoolSegments(t, dir) == 0 })
+}
+
+func TestSpoolEviction(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		eviction string
+		// spoolsAll reports whether every document is written to the spool, older ones being evicted.
+		spoolsAll bool
+	}{
+		{desc: "drop oldest", eviction: traefik_plugin_elastic.PolicyDropOldest, spoolsAll: true},
+		{desc: "drop newest", eviction: traefik_plugin_elastic.PolicyDropNewest},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			down := httptest.NewServer(http.NotFoundHandler())
+			down.Close()
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = down.URL
+			cfg.FlushDocuments = 1
+			// Spool documents one by one, rather than in batches of retries larger than a segment.
+			cfg.RetryConnectionAttempts = 1
+			cfg.SpoolDirectory = t.TempDir()
+			cfg.SpoolMaxBytes = 2048
+			cfg.SpoolSegmentBytes = 512
+			cfg.SpoolEviction = test.eviction
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+			elasticsearchLog := handler.(*traefik_plugin_elastic.ElasticsearchLog)
+
+			for i := 0; i < 20; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil))
+			}
+			waitFor(t, func() bool {
+				metrics := elasticsearchLog.Metrics()
+				if test.spoolsAll {
+					return metrics.Spooled == 20
+				}
+				return metrics.Spooled+metrics.SpoolDropped == 20
+			})
+
+			metrics := elasticsearchLog.Metrics()
+			if metrics.SpoolDropped == 0 {
+				t.Errorf("expected spooled documents to be dropped, got %+v", metrics)
+			}
+			if metrics.SpoolBytes <= 0 || metrics.SpoolBytes > cfg.SpoolMaxBytes {
+				t.Errorf("expected the spool size to be within (0, %d], got %d", cfg.SpoolMaxBytes, metrics.SpoolBytes)
+			}
+		})
+	}
+}
+
+func spoolSegments(t *testing.T, dir string) int {
+	t.Helper()
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(segments)
+}
@@ -0,0 +1,145 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	traceparentHeader = "Traceparent"
+	// maxRequestIDLength bounds the length of the request IDs accepted from clients.
+	maxRequestIDLength = 200
+	// requestIDChars are the characters of the request IDs accepted from clients.
+	requestIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_.:"
+)
+
+// Identifier is an object holding the identifier of a trace, span or transaction.
+type Identifier struct {
+	ID string `json:"id"`
+}
+
+// traceContext parses or starts the W3C Trace Context of requests and propagates it upstream.
+type traceContext struct{}
+
+// start returns the trace of req, the span of the caller, if any, and the span of the middleware
+// within the trace. The trace is read from the traceparent header, or started when the header is
+// missing or invalid, and the traceparent header forwarded upstream is replaced to make the span of
+// the middleware its parent.
+func (t *traceContext) start(req *http.Request) (traceID, parentID, spanID string) {
+	if t == nil {
+		return "", "", ""
+	}
+
+	traceID, parentID, flags, ok := parseTraceparent(req.Header.Get(traceparentHeader))
+	if !ok {
+		traceID, flags = randomHex(16), "00"
+		// A tracestate without a valid traceparent is meaningless.
+		req.Header.Del("Tracestate")
+	}
+	spanID = randomHex(8)
+	req.Header.Set(traceparentHeader, "00-"+traceID+"-"+spanID+"-"+flags)
+
+	return traceID, parentID, spanID
+}
+
+// parseTraceparent returns the trace ID, parent span ID and flags of a version 00 traceparent header, or
+// of a header of a later version, which must start with the same fields.
+func parseTraceparent(value string) (traceID, parentID, flags string, ok bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && value[55] != '-') {
+		return "", "", "", false
+	}
+
+	version := value[0:2]
+	traceID, parentID, flags = value[3:35], value[36:52], value[53:55]
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return "", "", "", false
+	}
+	if !isLowerHex(version) || version == "ff" || (version == "00" && len(value) != 55) {
+		return "", "", "", false
+	}
+	if !isLowerHex(traceID) || !isLowerHex(parentID) || !isLowerHex(flags) {
+		return "", "", "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < '0' || s[i] > '9') && (s[i] < 'a' || s[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes, hex-encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			// Fall back to the random part of a UUID, which is not expected to fail.
+			u := uuid.New()
+			copy(b, u[len(u)-n:])
+		}
+		for _, c := range b {
+			if c != 0 {
+				return hex.EncodeToString(b)
+			}
+		}
+	}
+}
+
+// requestID reads or assigns the ID of requests.
+type requestID struct {
+	header string
+	echo   bool
+}
+
+func newRequestID(header string, echo bool) *requestID {
+	if header == "" {
+		return nil
+	}
+	return &requestID{header: http.CanonicalHeaderKey(header), echo: echo}
+}
+
+// assign returns the ID of req, read from its request ID header, or generated and set on the request
+// forwarded upstream when the header is missing or invalid. The ID is set on the response when it is echoed.
+func (r *requestID) assign(rw http.ResponseWriter, req *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	id := strings.TrimSpace(req.Header.Get(r.header))
+	if !validRequestID(id) {
+		id = uuid.NewString()
+		req.Header.Set(r.header, id)
+	}
+	if r.echo {
+		rw.Header().Set(r.header, id)
+	}
+	return id
+}
+
+// validRequestID reports whether id, sent by a client, is short enough and only made of requestIDChars.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(requestIDChars, id[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
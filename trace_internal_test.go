@@ -0,0 +1,83 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import "testing"
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		value    string
+		traceID  string
+		parentID string
+		flags    string
+		ok       bool
+	}{
+		{
+			desc:     "version 00",
+			value:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID: "00f067aa0ba902b7",
+			flags:    "01",
+			ok:       true,
+		},
+		{
+			desc:     "surrounding whitespace",
+			value:    " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ",
+			traceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID: "00f067aa0ba902b7",
+			flags:    "00",
+			ok:       true,
+		},
+		{
+			desc:     "future version with extra fields",
+			value:    "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			traceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID: "00f067aa0ba902b7",
+			flags:    "01",
+			ok:       true,
+		},
+		{
+			desc:  "version 00 with extra fields",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		},
+		{
+			desc:  "version ff",
+			value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			desc:  "zero trace ID",
+			value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			desc:  "zero parent ID",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			desc:  "uppercase",
+			value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+		},
+		{
+			desc:  "wrong separators",
+			value: "00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+		},
+		{
+			desc:  "truncated",
+			value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		},
+		{
+			desc: "empty",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			traceID, parentID, flags, ok := parseTraceparent(test.value)
+			if ok != test.ok || traceID != test.traceID || parentID != test.parentID || flags != test.flags {
+				t.Errorf("expected (%q, %q, %q, %t), got (%q, %q, %q, %t)",
+					test.traceID, test.parentID, test.flags, test.ok, traceID, parentID, flags, ok)
+			}
+		})
+	}
+}
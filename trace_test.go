@@ -0,0 +1,195 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+func TestTraceContext(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		traceparent string
+		traceID     string
+		parentID    string
+		flags       string
+	}{
+		{
+			desc:        "incoming trace",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			traceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID:    "00f067aa0ba902b7",
+			flags:       "01",
+		},
+		{
+			desc:        "future version",
+			traceparent: "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			traceID:     "4bf92f3577b34da6a3ce929d0e0e4736",
+			parentID:    "00f067aa0ba902b7",
+			flags:       "01",
+		},
+		{
+			desc:  "missing traceparent",
+			flags: "00",
+		},
+		{
+			desc:        "invalid trace ID",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			flags:       "00",
+		},
+		{
+			desc:        "uppercase traceparent",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+			flags:       "00",
+		},
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.Schema = traefik_plugin_elastic.SchemaECS
+	cfg.TraceContext = true
+
+	var upstream string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+	})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for i, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			if test.traceparent != "" {
+				req.Header.Set("traceparent", test.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			docs := es.WaitForDocuments(t, i+1)
+			if len(docs) != i+1 {
+				t.Fatalf("expected %d indexed documents, got %d", i+1, len(docs))
+			}
+			doc := docs[i]
+
+			match := traceparentPattern.FindStringSubmatch(upstream)
+			if match == nil {
+				t.Fatalf("expected a valid upstream traceparent, got %q", upstream)
+			}
+			if test.traceID != "" && match[1] != test.traceID {
+				t.Errorf("expected the upstream trace ID %s, got %s", test.traceID, match[1])
+			}
+			if match[3] != test.flags {
+				t.Errorf("expected the upstream flags %s, got %s", test.flags, match[3])
+			}
+			if got := lookup(doc, "trace.id"); got != match[1] {
+				t.Errorf("expected trace.id %s, got %v", match[1], got)
+			}
+			if got := lookup(doc, "span.id"); got != match[2] {
+				t.Errorf("expected span.id %s, got %v", match[2], got)
+			}
+			if got := lookup(doc, "transaction.id"); got != match[2] {
+				t.Errorf("expected transaction.id %s, got %v", match[2], got)
+			}
+			if test.parentID == "" {
+				if got := lookup(doc, "parent"); got != nil {
+					t.Errorf("expected no parent, got %v", got)
+				}
+			} else if got := lookup(doc, "parent.id"); got != test.parentID {
+				t.Errorf("expected parent.id %s, got %v", test.parentID, got)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		requestID string
+		replaced  bool
+		echo      bool
+	}{
+		{
+			desc:      "incoming request ID",
+			requestID: "abc-123",
+		},
+		{
+			desc: "generated request ID",
+		},
+		{
+			desc:      "invalid request ID",
+			requestID: "abc 123<script>",
+			replaced:  true,
+		},
+		{
+			desc:      "request ID too long",
+			requestID: strings.Repeat("a", 201),
+			replaced:  true,
+		},
+		{
+			desc:      "echoed request ID",
+			requestID: "abc-123",
+			echo:      true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			es := newFakeElasticsearch(t)
+
+			cfg := loadConfig()
+			cfg.ElasticsearchURL = es.URL
+			cfg.RequestIDHeader = "X-Request-ID"
+			cfg.EchoRequestID = test.echo
+
+			var upstream string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstream = r.Header.Get("X-Request-ID")
+			})
+
+			handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+			if err != nil {
+				t.Fatalf("Could not create the middleware: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+			if test.requestID != "" {
+				req.Header.Set("X-Request-ID", test.requestID)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			docs := es.WaitForDocuments(t, 1)
+			if len(docs) != 1 {
+				t.Fatalf("expected 1 indexed document, got %d", len(docs))
+			}
+
+			if upstream == "" || (test.requestID != "" && (upstream == test.requestID) == test.replaced) {
+				t.Errorf("expected the upstream request ID %q to be replaced: %t, got %q", test.requestID, test.replaced, upstream)
+			}
+			if got := docs[0]["request_id"]; got != upstream {
+				t.Errorf("expected request_id %q, got %v", upstream, got)
+			}
+
+			echoed := rw.Header().Get("X-Request-ID")
+			if test.echo && echoed != upstream {
+				t.Errorf("expected the response request ID %q, got %q", upstream, echoed)
+			}
+			if !test.echo && echoed != "" {
+				t.Errorf("expected no response request ID, got %q", echoed)
+			}
+		})
+	}
+}
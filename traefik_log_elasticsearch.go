@@ -7,17 +7,13 @@ package traefik_plugin_elastic
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
-
-	"github.com/elastic/go-elasticsearch/v7"
-	"github.com/elastic/go-elasticsearch/v7/esapi"
-	"github.com/google/uuid"
+	"sync/atomic"
+	"text/template"
+	"time"
 )
 
 // Config is a structure that holds the configuration needed for the Elasticsearch plugin in Traefik.
@@ -26,7 +22,9 @@ type Config struct {
 	ElasticsearchURL string
 	// IndexName is the name of the Elasticsearch index that the plugin should write logs to.
 	IndexName string
-	// Message is the default log message that will be used if no specific message is provided in the log entry.
+	// Message is the log message of each entry. It is a Go text/template executed against the Document
+	// of the request, for example "{{.Method}} {{.Path}} -> {{.Status}} in {{.Duration}}". The
+	// CommonLogFormat and CombinedLogFormat presets render the request in the Apache log formats.
 	Message string
 	// APIKey is used for authentication with the Elasticsearch instance. This should be used if Username and Password are not provided.
 	APIKey string
@@ -37,21 +35,245 @@ type Config struct {
 	// VerifyTLS determines whether the plugin should verify the TLS certificate of the Elasticsearch instance.
 	// It is recommended to set this to true in production to prevent man-in-the-middle attacks.
 	VerifyTLS bool
+	// QueueSize is the number of documents that can wait for delivery to Elasticsearch.
+	// Documents are dropped when the queue is full.
+	QueueSize int
+	// QueueMaxBytes bounds the estimated memory used by the queued documents. It defaults to 32 MiB. It also
+	// bounds the documents waiting to be retried, which are spooled or dropped beyond it.
+	QueueMaxBytes int64
+	// QueuePolicy is what happens to new documents when the queue is full: drop-newest (the default) drops
+	// them, drop-oldest drops the oldest queued documents instead, block makes requests wait up to
+	// QueueBlockTimeout for room, and sample keeps only QueueSampleRate of the documents once the queue
+	// is half full.
+	QueuePolicy string
+	// QueueBlockTimeout is how long, as a Go duration string, requests wait for room in the queue with the
+	// block policy. It defaults to 100ms.
+	QueueBlockTimeout string
+	// QueueSampleRate is the share of the documents kept by the sample policy once the queue is half full,
+	// between 0 and 1. It defaults to 0.1.
+	QueueSampleRate float64
+	// Workers is the number of background workers delivering documents to Elasticsearch.
+	Workers int
+	// FlushBytes is the size, in bytes, of the documents a worker accumulates before sending a _bulk request.
+	FlushBytes int
+	// FlushDocuments is the number of documents a worker accumulates before sending a _bulk request.
+	FlushDocuments int
+	// FlushInterval is the maximum time, as a Go duration string, documents wait before being sent.
+	FlushInterval string
+	// ShutdownTimeout is how long, as a Go duration string, the queued documents are still delivered once
+	// the middleware is shut down, when Traefik cancels the context of New on a configuration change.
+	// It defaults to 5s. Documents not delivered in time are spooled, or dropped without a spool.
+	ShutdownTimeout string
+	// Schema is the layout of the indexed documents: legacy (the default) for the flat Document
+	// structure, or ecs for the Elastic Common Schema.
+	Schema string
+	// ECSVersion is the Elastic Common Schema version documents conform to when Schema is ecs.
+	ECSVersion string
+	// TrustedProxies lists the IP addresses and CIDR ranges of the proxies in front of Traefik. The client IP
+	// is read from the ForwardedHeader header only when it is set by these proxies.
+	TrustedProxies []string
+	// ForwardedHeader is the forwarding header the trusted proxies write: X-Forwarded-For (the default),
+	// Forwarded or X-Real-IP. The other forwarding headers are ignored, since clients can set them.
+	ForwardedHeader string
+	// GeoIPDatabases lists local MaxMind DB files, such as GeoLite2 City and GeoLite2 ASN, used to add the
+	// location and autonomous system of the client IP to the documents. A file used by several middleware
+	// instances is loaded once.
+	GeoIPDatabases []string
+	// GeoIPReloadInterval is how often, as a Go duration string, the GeoIP databases are checked for changes.
+	GeoIPReloadInterval string
+	// ParseUserAgent adds the browser, operating system and device parsed from the User-Agent header to the
+	// documents, and tags known bots and crawlers.
+	ParseUserAgent bool
+	// UserAgentRules is the path of a JSON ruleset replacing the built-in User-Agent parsing rules.
+	UserAgentRules string
+	// UserAgentCacheSize is the number of distinct User-Agent headers whose parsing results are cached.
+	UserAgentCacheSize int
+	// JWTClaims lists the claims decoded from the bearer token of the requests and added to the documents
+	// under user. Each entry is a claim name, optionally followed by = and the user field it is stored in,
+	// such as "tenant=domain". The sub, preferred_username, name, email and roles claims are stored in
+	// user.id, user.name, user.full_name, user.email and user.roles, and other claims under user.claims.
+	// The token itself is never indexed.
+	JWTClaims []string
+	// JWTCookie is the name of the cookie holding the token. The Authorization header is used when it is empty.
+	JWTCookie string
+	// JWTJWKSFile is the path of a local JSON Web Key Set used to verify the token signatures.
+	JWTJWKSFile string
+	// JWTKey is a PEM-encoded public key or certificate, or an HMAC secret, used to verify the token signatures.
+	// Claims of tokens whose signature cannot be verified, or that are expired or not valid yet according to their
+	// exp and nbf claims with one minute of clock skew, are not logged. Signatures are not verified when neither
+	// JWTJWKSFile nor JWTKey is set.
+	JWTKey string
+	// IdentityHeaders maps the identity headers set by an authentication proxy, such as Traefik ForwardAuth
+	// or Ory Oathkeeper, to the user fields of the documents. Each entry is a header name, optionally followed
+	// by : and the dotted path of a value inside a JSON or base64-encoded JSON header, then = and the user
+	// field, such as "X-User-Id=id" or "X-User:traits.email=email". Values mapped to id, name, full_name,
+	// email, domain and roles are stored in the matching user fields, and other values under user.claims.
+	IdentityHeaders []string
+	// ParseGraphQL adds the operation name and type, the top-level fields and a hash of the normalized query
+	// of GraphQL requests to the documents. Batched operations and persisted queries are supported.
+	ParseGraphQL bool
+	// GraphQLPaths lists the paths GraphQL requests are served on. It defaults to /graphql.
+	GraphQLPaths []string
+	// GraphQLVariables is how the operation variables are logged: drop (the default) leaves them out, and
+	// redact logs them with the values of the GraphQLRedactVariables keys masked. The variables query parameter of GET
+	// requests is dropped or redacted the same way.
+	GraphQLVariables string
+	// GraphQLRedactVariables lists the variable keys, matched case-insensitively at any depth, whose values are masked.
+	GraphQLRedactVariables []string
+	// GraphQLMaxBytes is the size of the largest GraphQL request body parsed. It defaults to 1 MiB. Only
+	// application/json and application/graphql bodies are read.
+	GraphQLMaxBytes int
+	// TraceContext adds the W3C Trace Context trace.id, parent.id, transaction.id and span.id to the documents. The trace
+	// is read from the traceparent header or started when the header is missing, and the traceparent header
+	// forwarded upstream is set to make the request handled by the middleware the parent of the upstream one.
+	TraceContext bool
+	// RequestIDHeader is the header holding the ID of the requests, such as X-Request-ID. The ID is added to
+	// the documents, and generated and forwarded upstream when the header is missing or invalid. It is disabled
+	// when empty.
+	RequestIDHeader string
+	// EchoRequestID sets the RequestIDHeader header on the responses.
+	EchoRequestID bool
+	// CaptureHeaders adds the request and response headers to the documents.
+	CaptureHeaders bool
+	// IncludeHeaders lists the headers to capture. All headers are captured when it is empty.
+	IncludeHeaders []string
+	// ExcludeHeaders lists headers that are never captured.
+	ExcludeHeaders []string
+	// RedactHeaders lists headers whose values are redacted, in addition to Authorization,
+	// Proxy-Authorization, Cookie and Set-Cookie which are always redacted.
+	RedactHeaders []string
+	// HeaderRedaction is how redacted values are replaced: mask (the default) or hash.
+	HeaderRedaction string
+	// RequestBodyMaxBytes is the number of request body bytes captured in the documents. Zero disables the capture.
+	RequestBodyMaxBytes int
+	// RequestBodyContentTypes lists the media types whose request bodies are captured, such as
+	// application/json or text/*. JSON, GraphQL, form and text bodies are captured when it is empty.
+	RequestBodyContentTypes []string
+	// ResponseBodyMaxBytes is the number of response body bytes captured in the documents of responses
+	// whose status is in ResponseBodyStatuses. Zero disables the capture.
+	ResponseBodyMaxBytes int
+	// ResponseBodyStatuses lists the status codes whose response bodies are captured, as comma-separated
+	// codes and ranges such as "400-599" (the default) or "404,500-504".
+	ResponseBodyStatuses string
+	// BodyEncoding is how captured bodies are stored: text (the default), which falls back to base64
+	// for binary content, or base64.
+	BodyEncoding string
+	// DocumentID is how documents are identified: uuid (the default) assigns random UUIDs, auto lets
+	// Elasticsearch assign IDs, request-id uses the request ID of RequestIDHeader followed by a hash of the index
+	// and timestamp of the document, and hash uses the SHA-256 hash of the document so that a document
+	// delivered twice is only stored once.
+	DocumentID string
+	// OpType is the _bulk action documents are written with: index (the default), or create, which never
+	// overwrites an existing document and makes redelivered documents count as indexed.
+	OpType string
+	// Refresh is the refresh policy of the writes to Elasticsearch: false (the default), true or wait_for.
+	// Setting it to true forces a refresh of the index on every write and should be avoided under load.
+	Refresh string
+	// RetryConnectionAttempts is the number of times a document is sent while Elasticsearch cannot be reached.
+	// It defaults to 3.
+	RetryConnectionAttempts int
+	// RetryTooManyRequestsAttempts is the number of times a document is sent while Elasticsearch answers
+	// 429 Too Many Requests. It defaults to 3.
+	RetryTooManyRequestsAttempts int
+	// RetryServerErrorAttempts is the number of times a document is sent while Elasticsearch answers with
+	// 5xx statuses. It defaults to 3. Documents rejected with other statuses, such as mapping errors, are
+	// never retried.
+	RetryServerErrorAttempts int
+	// RetryInitialBackoff is the delay, as a Go duration string, before the first retry. It doubles on each
+	// attempt, with a random jitter, up to RetryMaxBackoff. Longer Retry-After delays are honored. Retries are
+	// sent once their delay elapses, regardless of FlushInterval.
+	RetryInitialBackoff string
+	// RetryMaxBackoff is the maximum delay, as a Go duration string, between two attempts.
+	RetryMaxBackoff string
+	// DeadLetterIndex is the index documents given up on are written to, with the last error they failed
+	// with. Documents are written as strings in the document field.
+	DeadLetterIndex string
+	// DeadLetterFile is the path of a local NDJSON file documents given up on are appended to, with the
+	// last error they failed with. Only one of DeadLetterIndex and DeadLetterFile can be set.
+	DeadLetterFile string
+	// SpoolDirectory is the directory of a disk-backed spool keeping the documents that could not be
+	// delivered after their retries because of connection errors, 429 or 5xx statuses, until
+	// Elasticsearch is back. Spooled documents survive restarts. Configurations using the same directory
+	// share its spool, with the settings of the first one. The spool is disabled when empty.
+	SpoolDirectory string
+	// SpoolMaxBytes is the maximum size of the spool. It defaults to 256 MiB.
+	SpoolMaxBytes int64
+	// SpoolSegmentBytes is the size of the segment files of the spool. It defaults to 4 MiB.
+	SpoolSegmentBytes int64
+	// SpoolMaxAge is how long, as a Go duration string, documents are kept in the spool. It defaults to 24h.
+	SpoolMaxAge string
+	// SpoolEviction is what happens when the spool is full: drop-oldest (the default) evicts the oldest
+	// documents, and drop-newest drops the documents that do not fit.
+	SpoolEviction string
+	// CircuitBreakerFailureRate is the share of failed requests to Elasticsearch, between 0 and 1, that opens
+	// the circuit breaker. While it is open, documents are spooled or dropped without being sent. It is
+	// disabled when 0, the default.
+	CircuitBreakerFailureRate float64
+	// CircuitBreakerMinRequests is the number of requests sent within CircuitBreakerWindow before the
+	// circuit breaker can open. It defaults to 10.
+	CircuitBreakerMinRequests int
+	// CircuitBreakerWindow is the period, as a Go duration string, over which the failure rate is measured.
+	// It defaults to 10s.
+	CircuitBreakerWindow string
+	// CircuitBreakerOpenDuration is how long, as a Go duration string, the circuit breaker stays open before
+	// probing Elasticsearch again. It defaults to 30s.
+	CircuitBreakerOpenDuration string
+	// CircuitBreakerHalfOpenRequests is the number of probe requests that must succeed to close the circuit
+	// breaker again. It defaults to 1.
+	CircuitBreakerHalfOpenRequests int
+	// FailClosed makes the middleware reject requests with FailClosedStatus while their documents cannot
+	// be delivered to Elasticsearch. By default the middleware fails open: logging failures are counted
+	// and reported but never affect the proxied request. While rejecting requests, the workers send a bulk
+	// request that changes nothing to the index every FlushInterval, and accept requests again once it succeeds.
+	FailClosed bool
+	// FailClosedStatus is the status code returned to clients when a request is rejected in fail-closed mode.
+	FailClosedStatus int
+	// MaxConnections limits the number of connections opened to each Elasticsearch node. Zero means no limit.
+	MaxConnections int
+	// MaxIdleConnections is the number of idle connections kept open to each Elasticsearch node.
+	MaxIdleConnections int
+	// IdleConnTimeout is how long, as a Go duration string, an idle connection is kept open.
+	IdleConnTimeout string
+	// DialTimeout is the maximum time, as a Go duration string, to establish a connection to Elasticsearch.
+	DialTimeout string
+	// ResponseTimeout is the maximum time, as a Go duration string, to wait for the response headers of Elasticsearch.
+	ResponseTimeout string
+	// KeepAlive is the TCP keep-alive period, as a Go duration string, of the connections to Elasticsearch.
+	KeepAlive string
 }
 
-// CreateConfig returns a pointer to a Config struct with its fields initialized to zero values.
+// CreateConfig returns a pointer to a Config struct with its fields initialized to their default values.
 // This is a convenient way to create a new Config instance.
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		QueueSize:            defaultQueueSize,
+		Workers:              defaultWorkers,
+		FlushBytes:           defaultFlushBytes,
+		FlushDocuments:       defaultFlushDocuments,
+		FlushInterval:        defaultFlushInterval,
+		ShutdownTimeout:      defaultShutdownTimeout,
+		Schema:               defaultSchema,
+		ECSVersion:           defaultECSVersion,
+		HeaderRedaction:      defaultHeaderRedaction,
+		ResponseBodyStatuses: defaultResponseBodyStatuses,
+		BodyEncoding:         defaultBodyEncoding,
+		Refresh:              defaultRefresh,
+		FailClosedStatus:     http.StatusServiceUnavailable,
+		MaxIdleConnections:   defaultMaxIdleConnections,
+		IdleConnTimeout:      defaultIdleConnTimeout,
+		DialTimeout:          defaultDialTimeout,
+		ResponseTimeout:      defaultResponseTimeout,
+		KeepAlive:            defaultKeepAlive,
+	}
 }
 
 // ElasticsearchLog is a middleware handler that logs HTTP requests to an Elasticsearch instance.
 type ElasticsearchLog struct {
-	// Next is the next handler to be called in the middleware chain. The ElasticsearchLog handler will call this after logging the request.
+	// Next is the next handler to be called in the middleware chain. The ElasticsearchLog handler logs the request once this returns.
 	Next http.Handler
 	// Name is the name of the handler. This is mainly used for identification and debugging purposes.
 	Name string
-	// Message is the default message to be logged to Elasticsearch if no specific message is provided in the log entry.
+	// Message is the template of the message logged to Elasticsearch for each request.
 	Message string
 	// ElasticsearchURL is the URL of the Elasticsearch instance where the logs should be written to.
 	ElasticsearchURL string
@@ -66,10 +288,32 @@ type ElasticsearchLog struct {
 	// VerifyTLS determines whether the middleware should verify the TLS certificate of the Elasticsearch instance.
 	// It is recommended to set this to true in production to prevent man-in-the-middle attacks.
 	VerifyTLS bool
+	// FailClosed determines whether requests are rejected while their documents cannot be delivered.
+	FailClosed bool
+	// FailClosedStatus is the status code returned to clients when a request is rejected in fail-closed mode.
+	FailClosedStatus int
+
+	message      *template.Template
+	clientIP     *clientIPResolver
+	geoIP        *geoIP
+	userAgent    *userAgentParser
+	jwt          *jwtExtractor
+	identity     *identityExtractor
+	graphQL      *graphQLParser
+	trace        *traceContext
+	requestID    *requestID
+	headers      *headerFilter
+	requestBody  *bodyCapture
+	responseBody *responseBodyCapture
+	pipeline     *pipeline
+	metrics      *metrics
 }
 
-// New creates a new ElasticsearchLog middleware instance.
-func New(_ context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+// New creates a new ElasticsearchLog middleware instance. Instances with identical configurations share
+// the pipeline delivering their documents. The instance is shut down when ctx is done: once no instance
+// uses its pipeline anymore, the queued documents are flushed within the shutdown timeout and the
+// background workers stop.
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	if len(config.ElasticsearchURL) == 0 {
 		return nil, errors.New("missing Elasticsearch URL")
 	}
@@ -83,110 +327,178 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		return nil, errors.New("missing Elasticsearch credentials")
 	}
 
-	elasticsearchLog := &ElasticsearchLog{
-		ElasticsearchURL: config.ElasticsearchURL,
-		IndexName:        config.IndexName,
-		Next:             next,
-		Name:             name,
-		Message:          config.Message,
-		Username:         config.Username,
-		Password:         config.Password,
-		APIKey:           config.APIKey,
-		VerifyTLS:        config.VerifyTLS,
+	failClosedStatus := config.FailClosedStatus
+	if failClosedStatus == 0 {
+		failClosedStatus = http.StatusServiceUnavailable
+	}
+	if failClosedStatus < 100 || failClosedStatus > 999 {
+		return nil, fmt.Errorf("invalid fail-closed status code: %d", failClosedStatus)
 	}
 
-	return elasticsearchLog, nil
-}
+	message, err := newMessageTemplate(config.Message)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message template: %w", err)
+	}
 
-func convertToJSON(data map[string]interface{}) string {
-	jsonData, err := json.Marshal(data)
+	clientIP, err := newClientIPResolver(config.TrustedProxies, config.ForwardedHeader)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
-	return string(jsonData)
-}
 
-func (e *ElasticsearchLog) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var cfg elasticsearch.Config
-	if !e.VerifyTLS {
-		// Create a TLS config that skips certificate verification.
-		tlsConfig := &tls.Config{InsecureSkipVerify: true} //nolint:gosec
-
-		// Create a transport to use our TLS config.
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-
-		cfg = elasticsearch.Config{
-			Addresses: []string{
-				e.ElasticsearchURL,
-			},
-			Transport: transport,
-			Username:  e.Username,
-			Password:  e.Password,
-			APIKey:    e.APIKey,
+	geoIPReloadInterval, err := parseDuration(config.GeoIPReloadInterval, defaultGeoIPReloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GeoIP reload interval: %w", err)
+	}
+	var userAgent *userAgentParser
+	if config.ParseUserAgent {
+		if userAgent, err = newUserAgentParser(config.UserAgentRules, config.UserAgentCacheSize); err != nil {
+			return nil, err
 		}
-	} else {
-		cfg = elasticsearch.Config{
-			Addresses: []string{
-				e.ElasticsearchURL,
-			},
-			Username: e.Username,
-			Password: e.Password,
-			APIKey:   e.APIKey,
-			// Note: VerifyTLS is set to true by default when using the elasticsearch.Config struct.
+	}
+
+	jwt, err := newJWTExtractor(config.JWTClaims, config.JWTCookie, config.JWTJWKSFile, config.JWTKey)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := newIdentityExtractor(config.IdentityHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	var graphQL *graphQLParser
+	if config.ParseGraphQL {
+		graphQL, err = newGraphQLParser(config.GraphQLPaths, config.GraphQLVariables, config.GraphQLRedactVariables, config.GraphQLMaxBytes)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// Create a client
-	es, err := elasticsearch.NewClient(cfg)
+	headers, err := newHeaderFilter(config)
 	if err != nil {
-		log.Fatalf("Error creating the client: %s", err)
+		return nil, err
 	}
 
-	id := uuid.New().String()
+	requestBody, err := newBodyCapture(config.RequestBodyMaxBytes, config.RequestBodyContentTypes, config.BodyEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request body capture: %w", err)
+	}
 
-	msg := map[string]interface{}{
-		"message": e.Message,
+	responseBody, err := newResponseBodyCapture(config.ResponseBodyMaxBytes, config.ResponseBodyStatuses, config.BodyEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response body capture: %w", err)
 	}
 
-	// Set up the Elasticsearch request object directly
-	esReq := esapi.IndexRequest{
-		Index:      e.IndexName,
-		DocumentID: id,
-		Body:       strings.NewReader(convertToJSON(msg)),
-		Refresh:    "true",
+	pipeline, release, err := sharedPipelines.acquire(ctx, config)
+	if err != nil {
+		return nil, err
 	}
 
-	res, err := esReq.Do(req.Context(), es)
+	geoIP, err := newGeoIP(ctx, config.GeoIPDatabases, geoIPReloadInterval)
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
+		release()
+		return nil, err
 	}
-	defer func() {
-		err := res.Body.Close()
-		if err != nil {
-			log.Fatalf("Error closing the response body: %s", err)
-		}
-	}()
 
-	if res.IsError() {
-		log.Printf("[%s] Error indexing document ID=%d", res.Status(), 1)
-		log.Printf("%d", res.StatusCode)
-		return
+	elasticsearchLog := &ElasticsearchLog{
+		ElasticsearchURL: config.ElasticsearchURL,
+		IndexName:        config.IndexName,
+		Next:             next,
+		Name:             name,
+		Message:          config.Message,
+		Username:         config.Username,
+		Password:         config.Password,
+		APIKey:           config.APIKey,
+		VerifyTLS:        config.VerifyTLS,
+		FailClosed:       config.FailClosed,
+		FailClosedStatus: failClosedStatus,
+		message:          message,
+		clientIP:         clientIP,
+		geoIP:            geoIP,
+		userAgent:        userAgent,
+		jwt:              jwt,
+		identity:         identity,
+		graphQL:          graphQL,
+		requestID:        newRequestID(config.RequestIDHeader, config.EchoRequestID),
+		headers:          headers,
+		requestBody:      requestBody,
+		responseBody:     responseBody,
+		pipeline:         pipeline,
+		metrics:          pipeline.metrics,
 	}
 
-	// Deserialize the response into a map.
-	var r map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-		log.Printf("Error parsing the response body: %s", err)
-		return
+	if config.TraceContext {
+		elasticsearchLog.trace = &traceContext{}
 	}
 
-	version, ok := r["_version"].(float64)
-	if !ok {
-		log.Printf("Error: expected '_version' to be a float64")
+	return elasticsearchLog, nil
+}
+
+// ServeHTTP serves the request with the next handler and queues a document describing
+// the request and its response for delivery to Elasticsearch. Delivery failures never
+// affect the request, unless the middleware is in fail-closed mode.
+func (e *ElasticsearchLog) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if e.FailClosed && !e.pipeline.available() {
+		rejected := atomic.AddInt64(&e.metrics.rejected, 1)
+		log.Printf("Rejecting request: documents cannot be delivered to Elasticsearch (%d rejected so far)", rejected)
+		http.Error(rw, http.StatusText(e.FailClosedStatus), e.FailClosedStatus)
 		return
 	}
 
-	log.Printf("[%s] %s; version=%d", res.Status(), r["result"], int(version))
+	start := time.Now()
+	doc := NewDocument(req, e.Message, start)
+	doc.RequestID = e.requestID.assign(rw, req)
+	if traceID, parentID, spanID := e.trace.start(req); traceID != "" {
+		doc.Trace = &Identifier{ID: traceID}
+		if parentID != "" {
+			doc.Parent = &Identifier{ID: parentID}
+		}
+		doc.Transaction = &Identifier{ID: spanID}
+		doc.Span = &Identifier{ID: spanID}
+	}
+	doc.ClientIP, doc.ForwardedFor = e.clientIP.resolve(req)
+	doc.Geo, doc.AS = e.geoIP.lookup(doc.ClientIP)
+	doc.UserAgentDetails = e.userAgent.parse(doc.UserAgent)
+	doc.User = e.identity.extract(req, e.jwt.extract(req))
+	doc.GraphQL = e.graphQL.parse(req)
+	doc.Query = e.graphQL.redactQuery(req, doc.Query)
+	doc.RequestHeaders = e.headers.capture(req.Header)
+	requestBody := e.requestBody.captureRequestBody(req)
+
+	rec := newResponseRecorder(rw, start, e.responseBody)
+	e.Next.ServeHTTP(rec, req)
+	doc.setResponse(rec, time.Now())
+
+	if requestBody != nil {
+		content, truncated := requestBody.content()
+		doc.RequestBody = e.requestBody.body(content, doc.ContentLength, truncated)
+	}
+	if e.responseBody != nil {
+		doc.ResponseBody = e.responseBody.body(rec)
+	}
+	doc.ResponseHeaders = e.headers.capture(rec.Header())
+	doc.Message = renderMessage(e.message, doc)
+
+	e.pipeline.enqueue(doc)
+}
+
+// Metrics returns a snapshot of the delivery counters of the middleware, shared with the instances
+// that have an identical configuration.
+func (e *ElasticsearchLog) Metrics() Metrics {
+	return e.metrics.snapshot()
+}
 
-	e.Next.ServeHTTP(rw, req)
+// parseDuration parses value as a Go duration string, using fallback when value is empty.
+func parseDuration(value, fallback string) (time.Duration, error) {
+	if value == "" {
+		value = fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %s", value)
+	}
+	return d, nil
 }
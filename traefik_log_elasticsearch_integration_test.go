@@ -29,15 +29,9 @@ func TestIntegrationLogElasticsearch(t *testing.T) {
 		}
 	})
 
-	elasticsearchLog := &traefik_plugin_elastic.ElasticsearchLog{
-		Next:             next,
-		Name:             "test",
-		Message:          cfg.Message,
-		ElasticsearchURL: cfg.ElasticsearchURL,
-		IndexName:        cfg.IndexName,
-		Username:         cfg.Username,
-		Password:         cfg.Password,
-		VerifyTLS:        cfg.VerifyTLS,
+	elasticsearchLog, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
 	}
 
 	req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
@@ -0,0 +1,104 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// User is the authenticated user of a request, named after the ECS user fields.
+type User struct {
+	ID       string   `json:"id,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	FullName string   `json:"full_name,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Domain   string   `json:"domain,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	// Claims holds the extracted values that have no dedicated field.
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+// set stores value under field, which is an ECS user field name or any other name kept in Claims.
+func (u *User) set(field string, value interface{}) {
+	switch field {
+	case "id":
+		u.ID = stringValue(value)
+	case "name":
+		u.Name = stringValue(value)
+	case "full_name":
+		u.FullName = stringValue(value)
+	case "email":
+		u.Email = stringValue(value)
+	case "domain":
+		u.Domain = stringValue(value)
+	case "roles":
+		u.addRoles(stringValues(value))
+	default:
+		if u.Claims == nil {
+			u.Claims = make(map[string]interface{})
+		}
+		u.Claims[field] = value
+	}
+}
+
+// addRoles adds the roles not listed yet, since several claims or headers may grant the same role.
+func (u *User) addRoles(roles []string) {
+	for _, role := range roles {
+		known := false
+		for _, r := range u.Roles {
+			if r == role {
+				known = true
+				break
+			}
+		}
+		if !known {
+			u.Roles = append(u.Roles, role)
+		}
+	}
+}
+
+func (u *User) empty() bool {
+	return u.ID == "" && u.Name == "" && u.FullName == "" && u.Email == "" && u.Domain == "" &&
+		len(u.Roles) == 0 && len(u.Claims) == 0
+}
+
+// stringValue converts a decoded JSON value to a string.
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// stringValues converts a decoded JSON string or array, or a comma-separated string, to a list of strings.
+func stringValues(value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s := stringValue(item); s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	case string:
+		var values []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+		return values
+	default:
+		if s := stringValue(v); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+}
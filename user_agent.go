@@ -0,0 +1,245 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultUserAgentCacheSize = 1000
+
+// UserAgent is the structured form of a User-Agent header, named after the ECS user_agent fields.
+type UserAgent struct {
+	Name    string           `json:"name,omitempty"`
+	Version string           `json:"version,omitempty"`
+	OS      *UserAgentOS     `json:"os,omitempty"`
+	Device  *UserAgentDevice `json:"device,omitempty"`
+	// Bot reports whether the user agent is a known bot or crawler.
+	Bot bool `json:"bot,omitempty"`
+}
+
+// UserAgentOS is the operating system a user agent runs on.
+type UserAgentOS struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// UserAgentDevice is the device a user agent runs on.
+type UserAgentDevice struct {
+	Name string `json:"name"`
+}
+
+// defaultUserAgentRules is the built-in ruleset. It is kept in the source rather than in an
+// embedded file so that the plugin runs under Yaegi, and can be replaced with UserAgentRules.
+// Within each list the first matching rule wins.
+const defaultUserAgentRules = `{
+  "bots": [
+    {"regex": "(Googlebot|AdsBot-Google|Mediapartners-Google|Google-InspectionTool)(?:/(\\d+[\\.\\d]*))?", "name": "$1", "version": "$2"},
+    {"regex": "(bingbot|BingPreview|msnbot)(?:/(\\d+[\\.\\d]*))?", "name": "$1", "version": "$2"},
+    {"regex": "(YandexBot|DuckDuckBot|Baiduspider|Applebot|GPTBot|ClaudeBot|PetalBot|AhrefsBot|SemrushBot|MJ12bot|DotBot)(?:/(\\d+[\\.\\d]*))?", "name": "$1", "version": "$2"},
+    {"regex": "(facebookexternalhit|Twitterbot|Slackbot|LinkedInBot|Discordbot|TelegramBot|WhatsApp)(?:/(\\d+[\\.\\d]*))?", "name": "$1", "version": "$2"},
+    {"regex": "(?i)\\b([\\w-]*(?:bot|crawler|spider))\\b(?:/(\\d+[\\.\\d]*))?", "name": "$1", "version": "$2"}
+  ],
+  "browsers": [
+    {"regex": "Edg(?:e|A|iOS)?/(\\d+[\\.\\d]*)", "name": "Edge"},
+    {"regex": "OPR/(\\d+[\\.\\d]*)", "name": "Opera"},
+    {"regex": "Opera/.*Version/(\\d+[\\.\\d]*)", "name": "Opera"},
+    {"regex": "SamsungBrowser/(\\d+[\\.\\d]*)", "name": "Samsung Internet"},
+    {"regex": "(?:Firefox|FxiOS)/(\\d+[\\.\\d]*)", "name": "Firefox"},
+    {"regex": "(?:Chrome|CriOS)/(\\d+[\\.\\d]*)", "name": "Chrome"},
+    {"regex": "Version/(\\d+[\\.\\d]*).*Safari/", "name": "Safari"},
+    {"regex": "MSIE (\\d+[\\.\\d]*)", "name": "IE"},
+    {"regex": "Trident/.*rv:(\\d+[\\.\\d]*)", "name": "IE"},
+    {"regex": "(curl|Wget|PostmanRuntime|okhttp|python-requests|Go-http-client|axios|node-fetch|Apache-HttpClient)/(\\d+[\\.\\d]*)", "name": "$1", "version": "$2"}
+  ],
+  "os": [
+    {"regex": "Windows NT 10\\.0", "name": "Windows", "version": "10"},
+    {"regex": "Windows NT 6\\.3", "name": "Windows", "version": "8.1"},
+    {"regex": "Windows NT 6\\.2", "name": "Windows", "version": "8"},
+    {"regex": "Windows NT 6\\.1", "name": "Windows", "version": "7"},
+    {"regex": "Windows", "name": "Windows"},
+    {"regex": "iPad.*OS (\\d+[_\\.\\d]*)", "name": "iPadOS"},
+    {"regex": "(?:iPhone|CPU) OS (\\d+[_\\.\\d]*)", "name": "iOS"},
+    {"regex": "Mac OS X (\\d+[_\\.\\d]*)", "name": "Mac OS X"},
+    {"regex": "Android (\\d+[\\.\\d]*)", "name": "Android"},
+    {"regex": "CrOS \\S+ (\\d+[\\.\\d]*)", "name": "Chrome OS"},
+    {"regex": "Ubuntu", "name": "Ubuntu"},
+    {"regex": "Linux", "name": "Linux"}
+  ],
+  "devices": [
+    {"regex": "iPhone", "name": "iPhone"},
+    {"regex": "iPad", "name": "iPad"},
+    {"regex": "Macintosh", "name": "Mac"},
+    {"regex": "Android.*Mobile", "name": "Generic Smartphone"},
+    {"regex": "Android", "name": "Generic Tablet"}
+  ]
+}`
+
+// userAgentRule matches a User-Agent header. Name and version may refer to the groups of the
+// regular expression as $1, $2 and so on; version defaults to the first group.
+type userAgentRule struct {
+	Regex   string `json:"regex"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+
+	re *regexp.Regexp
+}
+
+// userAgentRules is a ruleset in the JSON format of defaultUserAgentRules.
+type userAgentRules struct {
+	Bots     []*userAgentRule `json:"bots"`
+	Browsers []*userAgentRule `json:"browsers"`
+	OS       []*userAgentRule `json:"os"`
+	Devices  []*userAgentRule `json:"devices"`
+}
+
+// userAgentParser parses User-Agent headers and caches the results of the most recent ones.
+type userAgentParser struct {
+	rules *userAgentRules
+	cache *lruCache
+}
+
+// newUserAgentParser creates a parser using the ruleset in the rulesPath file, or the built-in
+// ruleset when rulesPath is empty.
+func newUserAgentParser(rulesPath string, cacheSize int) (*userAgentParser, error) {
+	data := []byte(defaultUserAgentRules)
+	if rulesPath != "" {
+		var err error
+		if data, err = os.ReadFile(rulesPath); err != nil {
+			return nil, fmt.Errorf("error reading the user agent rules: %w", err)
+		}
+	}
+
+	rules := &userAgentRules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("invalid user agent rules: %w", err)
+	}
+	for _, list := range [][]*userAgentRule{rules.Bots, rules.Browsers, rules.OS, rules.Devices} {
+		for _, rule := range list {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid user agent rule %q: %w", rule.Regex, err)
+			}
+			rule.re = re
+			if rule.Version == "" && re.NumSubexp() > 0 {
+				rule.Version = "$1"
+			}
+		}
+	}
+
+	if cacheSize <= 0 {
+		cacheSize = defaultUserAgentCacheSize
+	}
+
+	return &userAgentParser{rules: rules, cache: newLRUCache(cacheSize)}, nil
+}
+
+// parse returns the structured form of header, or nil when nothing in it is recognized.
+func (p *userAgentParser) parse(header string) *UserAgent {
+	if p == nil || header == "" {
+		return nil
+	}
+
+	if cached, ok := p.cache.get(header); ok {
+		ua, _ := cached.(*UserAgent)
+		return ua
+	}
+
+	ua := &UserAgent{}
+	if name, version, ok := matchUserAgentRules(p.rules.Bots, header); ok {
+		ua.Name, ua.Version, ua.Bot = name, version, true
+		ua.Device = &UserAgentDevice{Name: "Spider"}
+	} else if name, version, ok := matchUserAgentRules(p.rules.Browsers, header); ok {
+		ua.Name, ua.Version = name, version
+	}
+	if name, version, ok := matchUserAgentRules(p.rules.OS, header); ok {
+		ua.OS = &UserAgentOS{Name: name, Version: strings.ReplaceAll(version, "_", ".")}
+	}
+	if name, _, ok := matchUserAgentRules(p.rules.Devices, header); ok && ua.Device == nil {
+		ua.Device = &UserAgentDevice{Name: name}
+	}
+
+	if ua.Name == "" && ua.OS == nil && ua.Device == nil {
+		ua = nil
+	}
+	p.cache.add(header, ua)
+
+	return ua
+}
+
+// matchUserAgentRules returns the name and version given by the first rule matching header.
+func matchUserAgentRules(rules []*userAgentRule, header string) (string, string, bool) {
+	for _, rule := range rules {
+		match := rule.re.FindStringSubmatchIndex(header)
+		if match == nil {
+			continue
+		}
+
+		name := string(rule.re.ExpandString(nil, rule.Name, header, match))
+		version := string(rule.re.ExpandString(nil, rule.Version, header, match))
+		return name, version, true
+	}
+	return "", "", false
+}
+
+// lruCache is a size-bounded, least recently used cache safe for concurrent use.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lruCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+
+	entry, _ := element.Value.(*lruEntry)
+	return entry.value, true
+}
+
+func (c *lruCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		element.Value = &lruEntry{key: key, value: value}
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		if entry, ok := oldest.Value.(*lruEntry); ok {
+			delete(c.entries, entry.key)
+		}
+	}
+}
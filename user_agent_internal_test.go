@@ -0,0 +1,118 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUserAgentParserParse(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		userAgent string
+		expected  *UserAgent
+	}{
+		{
+			desc:      "Chrome on Windows",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36",
+			expected: &UserAgent{
+				Name:    "Chrome",
+				Version: "118.0.0.0",
+				OS:      &UserAgentOS{Name: "Windows", Version: "10"},
+			},
+		},
+		{
+			desc:      "Safari on iPhone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1",
+			expected: &UserAgent{
+				Name:    "Safari",
+				Version: "17.0",
+				OS:      &UserAgentOS{Name: "iOS", Version: "17.0.3"},
+				Device:  &UserAgentDevice{Name: "iPhone"},
+			},
+		},
+		{
+			desc:      "Safari on iPad",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1",
+			expected: &UserAgent{
+				Name:    "Safari",
+				Version: "16.0",
+				OS:      &UserAgentOS{Name: "iPadOS", Version: "16.0"},
+				Device:  &UserAgentDevice{Name: "iPad"},
+			},
+		},
+		{
+			desc:      "Chrome on iPad",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/119.0.6045.109 Mobile/15E148 Safari/604.1",
+			expected: &UserAgent{
+				Name:    "Chrome",
+				Version: "119.0.6045.109",
+				OS:      &UserAgentOS{Name: "iPadOS", Version: "17.1"},
+				Device:  &UserAgentDevice{Name: "iPad"},
+			},
+		},
+		{
+			desc:      "Edge is not reported as Chrome",
+			userAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46",
+			expected: &UserAgent{
+				Name:    "Edge",
+				Version: "118.0.2088.46",
+				OS:      &UserAgentOS{Name: "Mac OS X", Version: "10.15.7"},
+				Device:  &UserAgentDevice{Name: "Mac"},
+			},
+		},
+		{
+			desc:      "Firefox on Android",
+			userAgent: "Mozilla/5.0 (Android 14; Mobile; rv:119.0) Gecko/119.0 Firefox/119.0",
+			expected: &UserAgent{
+				Name:    "Firefox",
+				Version: "119.0",
+				OS:      &UserAgentOS{Name: "Android", Version: "14"},
+				Device:  &UserAgentDevice{Name: "Generic Smartphone"},
+			},
+		},
+		{
+			desc:      "Googlebot",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			expected: &UserAgent{
+				Name:    "Googlebot",
+				Version: "2.1",
+				Bot:     true,
+				Device:  &UserAgentDevice{Name: "Spider"},
+			},
+		},
+		{
+			desc:      "unknown crawler",
+			userAgent: "Mozilla/5.0 (compatible; ExampleCrawler; +https://example.com)",
+			expected: &UserAgent{
+				Name:   "ExampleCrawler",
+				Bot:    true,
+				Device: &UserAgentDevice{Name: "Spider"},
+			},
+		},
+		{
+			desc:      "curl",
+			userAgent: "curl/8.4.0",
+			expected:  &UserAgent{Name: "curl", Version: "8.4.0"},
+		},
+		{
+			desc:      "unrecognized",
+			userAgent: "something else",
+		},
+	}
+
+	p, err := newUserAgentParser("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := p.parse(test.userAgent); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	traefik_plugin_elastic "github.com/alkem-io/traefik-plugin-elastic"
+)
+
+func TestUserAgentParsing(t *testing.T) {
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.ParseUserAgent = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (iPad; CPU OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	docs := es.WaitForDocuments(t, 1)
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 indexed document, got %d", len(docs))
+	}
+
+	expected := map[string]interface{}{
+		"name":    "Safari",
+		"version": "16.0",
+		"os":      map[string]interface{}{"name": "iPadOS", "version": "16.0"},
+		"device":  map[string]interface{}{"name": "iPad"},
+	}
+	if got := docs[0]["user_agent_details"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestUserAgentCustomRules(t *testing.T) {
+	rules := filepath.Join(t.TempDir(), "rules.json")
+	err := os.WriteFile(rules, []byte(`{
+  "bots": [{"regex": "HealthChecker/(\\d+)", "name": "Health checker"}],
+  "browsers": [{"regex": "AlkemioClient/(\\d+[\\.\\d]*)", "name": "Alkemio"}]
+}`), 0o600)
+	if err != nil {
+		t.Fatalf("Could not write the rules: %v", err)
+	}
+
+	es := newFakeElasticsearch(t)
+
+	cfg := loadConfig()
+	cfg.ElasticsearchURL = es.URL
+	cfg.ParseUserAgent = true
+	cfg.UserAgentRules = rules
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := traefik_plugin_elastic.New(testContext(t), next, cfg, "test")
+	if err != nil {
+		t.Fatalf("Could not create the middleware: %v", err)
+	}
+
+	for _, userAgent := range []string{"AlkemioClient/1.2.3", "HealthChecker/2"} {
+		req := httptest.NewRequest(http.MethodGet, "http://test.com/foo", nil)
+		req.Header.Set("User-Agent", userAgent)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	docs := es.WaitForDocuments(t, 2)
+	if len(docs) != 2 {
+		t.Fatalf("expected 2 indexed documents, got %d", len(docs))
+	}
+
+	expected := []interface{}{
+		map[string]interface{}{"name": "Alkemio", "version": "1.2.3"},
+		map[string]interface{}{"name": "Health checker", "version": "2", "bot": true, "device": map[string]interface{}{"name": "Spider"}},
+	}
+	for i, doc := range docs {
+		if got := doc["user_agent_details"]; !reflect.DeepEqual(got, expected[i]) {
+			t.Errorf("expected %v, got %v", expected[i], got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build !generated
+// +build !generated
+
+package traefik_plugin_elastic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUserSetRoles(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		values   []interface{}
+		expected []string
+	}{
+		{
+			desc:     "comma-separated string",
+			values:   []interface{}{"admin, editor"},
+			expected: []string{"admin", "editor"},
+		},
+		{
+			desc:     "array",
+			values:   []interface{}{[]interface{}{"admin", "", "editor"}},
+			expected: []string{"admin", "editor"},
+		},
+		{
+			desc:     "duplicates within a value",
+			values:   []interface{}{"admin, editor, admin"},
+			expected: []string{"admin", "editor"},
+		},
+		{
+			desc:     "duplicates across values",
+			values:   []interface{}{[]interface{}{"admin", "editor"}, "editor, viewer"},
+			expected: []string{"admin", "editor", "viewer"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			u := &User{}
+			for _, value := range test.values {
+				u.set("roles", value)
+			}
+			if !reflect.DeepEqual(u.Roles, test.expected) {
+				t.Errorf("expected roles %v, got %v", test.expected, u.Roles)
+			}
+		})
+	}
+}